@@ -39,6 +39,26 @@ func WriteFileOrStd(path string, data []byte, perm os.FileMode) error {
 	return os.WriteFile(path, data, perm)
 }
 
+// CreateFileOrStd opens the given path for writing, or stdout if path == "+",
+// or stderr if path == "-". Closing stdout or stderr does nothing.
+func CreateFileOrStd(path string, perm os.FileMode) (io.WriteCloser, error) {
+	switch path {
+	case "+":
+		return nopWriteCloser{os.Stdout}, nil
+	case "-":
+		return nopWriteCloser{os.Stderr}, nil
+	}
+	return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
 // ExpandHome expands ~ to the user's home directory in a given path
 func ExpandHome(path string) string {
 	if strings.HasPrefix(path, "~") {
@@ -0,0 +1,261 @@
+package filetree
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// The PAX records of tar headers hold Entry.Hash and (with --metadata)
+// Entry.MTime. They are named like extended attributes, GNU tar and bsdtar
+// warn about keywords they don't know. Zip uses the file comment for the hash.
+const (
+	paxHashRecord  = "SCHILY.xattr.user.oat.xxhash"
+	paxMTimeRecord = "SCHILY.xattr.user.oat.mtime"
+)
+
+// archiveModTime returns the mtime of the archive member for entry: the
+// recorded one, the one of the file it was read from or now
+func archiveModTime(p string, entry Entry, now time.Time) (time.Time, error) {
+	if entry.MTime != "" {
+		mtime, err := parseMTime(entry.MTime)
+		if err != nil {
+			return mtime, fmt.Errorf("%s: invalid mtime %q: %w", p, entry.MTime, err)
+		}
+		return mtime, nil
+	}
+	if !entry.modTime.IsZero() {
+		return entry.modTime, nil
+	}
+	return now, nil
+}
+
+// checkArchivable returns an error for entries archives can't represent
+func checkArchivable(p string, entry Entry) error {
+	if entry.Delete || entry.RenamedFrom != "" {
+		return fmt.Errorf("%s: deletions and renames can't be stored in an archive", p)
+	}
+	if entry.Truncated {
+		return fmt.Errorf("%s: truncated files can't be stored in an archive (see --file-size-policy)", p)
+	}
+	return nil
+}
+
+// tarTreeWriter writes a (optionally gzipped) tar archive, the Entry perms
+// become the header modes
+type tarTreeWriter struct {
+	tw  *tar.Writer
+	zw  *gzip.Writer
+	now time.Time
+}
+
+func newTarTreeWriter(w io.Writer, gz bool) *tarTreeWriter {
+	t := &tarTreeWriter{now: time.Now()}
+	if gz {
+		t.zw = gzip.NewWriter(w)
+		w = t.zw
+	}
+	t.tw = tar.NewWriter(w)
+	return t
+}
+
+func (t *tarTreeWriter) Write(p string, entry Entry) error {
+	if err := checkArchivable(p, entry); err != nil {
+		return err
+	}
+	mtime, err := archiveModTime(p, entry, t.now)
+	if err != nil {
+		return err
+	}
+	if entry.isSymlink() {
+		return t.tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeSymlink,
+			Name:     p,
+			Linkname: entry.Target,
+			Mode:     0o777,
+			ModTime:  mtime,
+			Format:   tar.FormatPAX,
+		})
+	}
+	perm, err := parsePerm(entry.Perm)
+	if err != nil {
+		return fmt.Errorf("%s: invalid perm %q: %w", p, entry.Perm, err)
+	}
+	content, err := entry.decodedContent()
+	if err != nil {
+		return fmt.Errorf("%s: %w", p, err)
+	}
+	hdr := &tar.Header{
+		Typeflag:   tar.TypeReg,
+		Name:       p,
+		Mode:       int64(perm.Perm()),
+		Size:       int64(len(content)),
+		ModTime:    mtime,
+		Format:     tar.FormatPAX,
+		PAXRecords: map[string]string{},
+	}
+	if entry.Hash != "" {
+		hdr.PAXRecords[paxHashRecord] = entry.Hash
+	}
+	if entry.MTime != "" {
+		hdr.PAXRecords[paxMTimeRecord] = entry.MTime
+	}
+	if err := t.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.WriteString(t.tw, content)
+	return err
+}
+
+func (t *tarTreeWriter) Close() error {
+	if err := t.tw.Close(); err != nil {
+		return err
+	}
+	if t.zw != nil {
+		return t.zw.Close()
+	}
+	return nil
+}
+
+// decodeTar reads regular files and symlinks from a (optionally gzipped) tar
+// archive
+func decodeTar(r io.Reader, gz bool) (map[string]Entry, error) {
+	if gz {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	tree := map[string]Entry{}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag == tar.TypeSymlink {
+			tree[archiveEntryName(hdr.Name)] = Entry{Type: EntryTypeSymlink, Target: hdr.Linkname}
+			continue
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue // directories are implied by the file paths
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		entry := contentEntry(fmt.Sprintf("%04o", hdr.Mode&0o777), b)
+		entry.Hash = hdr.PAXRecords[paxHashRecord]
+		entry.MTime = hdr.PAXRecords[paxMTimeRecord]
+		tree[archiveEntryName(hdr.Name)] = entry
+	}
+	return tree, nil
+}
+
+// zipTreeWriter writes a zip archive, the Entry perms become the file modes
+type zipTreeWriter struct {
+	zw  *zip.Writer
+	now time.Time
+}
+
+func newZipTreeWriter(w io.Writer) *zipTreeWriter {
+	return &zipTreeWriter{zw: zip.NewWriter(w), now: time.Now()}
+}
+
+func (z *zipTreeWriter) Write(p string, entry Entry) error {
+	if err := checkArchivable(p, entry); err != nil {
+		return err
+	}
+	mtime, err := archiveModTime(p, entry, z.now)
+	if err != nil {
+		return err
+	}
+	hdr := &zip.FileHeader{
+		Name:     p,
+		Method:   zip.Deflate,
+		Comment:  entry.Hash,
+		Modified: mtime,
+	}
+	var content string
+	if entry.isSymlink() {
+		// like Info-ZIP, the content of a symlink is its target
+		hdr.SetMode(os.ModeSymlink | 0o777)
+		content = entry.Target
+	} else {
+		perm, err := parsePerm(entry.Perm)
+		if err != nil {
+			return fmt.Errorf("%s: invalid perm %q: %w", p, entry.Perm, err)
+		}
+		hdr.SetMode(perm.Perm())
+		content, err = entry.decodedContent()
+		if err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+	}
+	w, err := z.zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, content)
+	return err
+}
+
+func (z *zipTreeWriter) Close() error {
+	return z.zw.Close()
+}
+
+// decodeZip reads regular files and symlinks from a zip archive
+func decodeZip(data []byte) (map[string]Entry, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+
+	tree := map[string]Entry{}
+	for _, f := range zr.File {
+		mode := f.Mode()
+		isLink := mode&os.ModeSymlink != 0
+		if !mode.IsRegular() && !isLink {
+			continue // directories are implied by the file paths
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		b, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		if isLink {
+			tree[archiveEntryName(f.Name)] = Entry{Type: EntryTypeSymlink, Target: string(b)}
+			continue
+		}
+		perm := mode.Perm()
+		if perm == 0 {
+			perm = 0o644 // archives created without unix attributes
+		}
+		entry := contentEntry(fmt.Sprintf("%04o", perm), b)
+		entry.Hash = f.Comment
+		tree[archiveEntryName(f.Name)] = entry
+	}
+	return tree, nil
+}
+
+// archiveEntryName normalizes names like "./foo/bar" to "foo/bar"
+func archiveEntryName(name string) string {
+	return path.Clean(strings.TrimPrefix(name, "./"))
+}
@@ -0,0 +1,103 @@
+package filetree
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTarRecords(t *testing.T) {
+	mtime := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+	tree := map[string]Entry{
+		"hashed.txt":   {Perm: "0644", Hash: "0123456789abcdef", Content: "a\n"},
+		"metadata.txt": {Perm: "0755", MTime: formatMTime(mtime), Content: "b\n"},
+		"plain.txt":    {Perm: "0644", Content: "c\n", modTime: mtime},
+		"new.txt":      {Perm: "0644", Content: "d\n"},
+	}
+	start := time.Now().Add(-time.Second)
+	data, err := encodeTree(tree, FormatTar)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		for key := range hdr.PAXRecords {
+			// keywords without a dot are the standard ones like mtime
+			if strings.Contains(key, ".") && !strings.HasPrefix(key, "SCHILY.xattr.") {
+				t.Errorf("%s: PAX record %s isn't namespaced", hdr.Name, key)
+			}
+		}
+		switch hdr.Name {
+		case "metadata.txt", "plain.txt":
+			if !hdr.ModTime.Equal(mtime) {
+				t.Errorf("%s: mtime %s, want %s", hdr.Name, hdr.ModTime, mtime)
+			}
+		default:
+			if hdr.ModTime.Before(start) {
+				t.Errorf("%s: mtime %s, want the current time", hdr.Name, hdr.ModTime)
+			}
+		}
+	}
+
+	got, err := decodeTree(data, FormatTar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for p, want := range tree {
+		want.modTime = time.Time{}
+		if got[p] != want {
+			t.Errorf("%s: got %#v, want %#v", p, got[p], want)
+		}
+	}
+
+	// GNU tar warns about every record it doesn't know
+	if _, err := exec.LookPath("tar"); err == nil {
+		archive := filepath.Join(t.TempDir(), "tree.tar")
+		if err := os.WriteFile(archive, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		out, err := exec.Command("tar", "-tvf", archive).CombinedOutput()
+		if err != nil || strings.Contains(string(out), "Ignoring") || strings.Contains(string(out), "1970-01-01") {
+			t.Errorf("tar -tvf: %v\n%s", err, out)
+		}
+	}
+}
+
+// Members get the mtime of their file when flattened without --metadata
+func TestArchiveModTimes(t *testing.T) {
+	src := t.TempDir()
+	writeTestFiles(t, src, map[string]string{"a.txt": "a\n"})
+	mtime := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(src, "a.txt"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	defer keep(&OutputFormat)()
+	for _, format := range []string{FormatTar, FormatZip} {
+		OutputFormat = format
+		out := filepath.Join(t.TempDir(), "out")
+		if err := DirTreeToYAML(src, out, []string{}, false); err != nil {
+			t.Fatal(err)
+		}
+		cmd := exec.Command("tar", "-tvf", out)
+		if format == FormatZip {
+			cmd = exec.Command("unzip", "-l", out)
+		}
+		if _, err := exec.LookPath(cmd.Args[0]); err != nil {
+			continue
+		}
+		listing, err := cmd.CombinedOutput()
+		if err != nil || !strings.Contains(string(listing), "2023") {
+			t.Errorf("%s: %v\n%s", format, err, listing)
+		}
+	}
+}
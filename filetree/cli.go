@@ -1,12 +1,20 @@
 package filetree
 
 import (
+	"errors"
+	"os"
+	"runtime"
+	"time"
+
 	"github.com/mrvnmyr/oat/common"
 	"github.com/spf13/cobra"
 )
 
 var NoIgnores bool
 
+// OutputPath is where flatten writes to, + is stdout
+var OutputPath string = "+"
+
 var Cmd = &cobra.Command{
 	Use: "filetree",
 }
@@ -19,22 +27,36 @@ var cmdFlatten = &cobra.Command{
 		for i, _ := range args {
 			args[i] = common.ExpandHome(args[i])
 		}
+		OutputPath = common.ExpandHome(OutputPath)
+		if Watch {
+			if Rev != "" {
+				common.Check(errors.New("--watch can't be used with --rev, a revision doesn't change"))
+			}
+			err := WatchFlatten(args, OutputPath, NoIgnores)
+			common.Check(err)
+			return
+		}
+		if Rev != "" {
+			err := RevTreeToYAML(Rev, args, OutputPath, NoIgnores)
+			common.Check(err)
+			return
+		}
 		if len(args) == 0 {
 			// Seek .flattenignore/.flattenallow as before
-			err := DirTreeToYAML("", "+", []string{}, true)
+			err := DirTreeToYAML("", OutputPath, []string{}, true)
 			common.Check(err)
 			return
 		}
 
 		// Pass args as files or directories to flatten
-		err := FlattenArgsToYAML(args, "+", NoIgnores)
+		err := FlattenArgsToYAML(args, OutputPath, NoIgnores)
 		common.Check(err)
 	},
 }
 
 var cmdExpand = &cobra.Command{
 	Use:  "expand [input] [output-root]",
-	Args: cobra.RangeArgs(0, 1),
+	Args: cobra.RangeArgs(0, 2),
 	Run: func(cmd *cobra.Command, args []string) {
 		path := "-"
 		outputRoot := "."
@@ -46,16 +68,164 @@ var cmdExpand = &cobra.Command{
 		}
 
 		err := YAMLToDirTree(path, outputRoot)
+		if errors.Is(err, ErrChangesPending) {
+			os.Exit(1)
+		}
+		common.Check(err)
+	},
+}
+
+var cmdVerify = &cobra.Command{
+	Use:  "verify <snapshot> [root]",
+	Args: cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		root := "."
+		if len(args) >= 2 {
+			root = args[1]
+		}
+
+		err := VerifyTree(args[0], root)
+		if errors.Is(err, ErrDrift) {
+			os.Exit(1)
+		}
+		common.Check(err)
+	},
+}
+
+var cmdApply = &cobra.Command{
+	Use:  "apply [patch] [output-root]",
+	Args: cobra.RangeArgs(0, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		path := "-"
+		outputRoot := "."
+		if len(args) >= 1 {
+			path = args[0]
+		}
+		if len(args) >= 2 {
+			outputRoot = args[1]
+		}
+
+		err := ApplyPatch(path, outputRoot)
+		if errors.Is(err, ErrChangesPending) {
+			os.Exit(1)
+		}
+		common.Check(err)
+	},
+}
+
+var cmdDiff = &cobra.Command{
+	Use:  "diff <snapshot-or-dir> <snapshot-or-dir>",
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := DiffTrees(common.ExpandHome(args[0]), common.ExpandHome(args[1]))
+		if errors.Is(err, ErrTreesDiffer) {
+			os.Exit(1)
+		}
+		common.Check(err)
+	},
+}
+
+var cmdLs = &cobra.Command{
+	Use:  "ls [files-or-dirs...]",
+	Args: cobra.ArbitraryArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		for i := range args {
+			args[i] = common.ExpandHome(args[i])
+		}
+		err := ListTree(args, NoIgnores)
+		common.Check(err)
+	},
+}
+
+var cmdServe = &cobra.Command{
+	Use:  "serve [root]",
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		root := ""
+		if len(args) == 1 {
+			root = common.ExpandHome(args[0])
+		}
+		ServeTokenFile = common.ExpandHome(ServeTokenFile)
+		err := Serve(root)
 		common.Check(err)
 	},
 }
 
 func init() {
 	Cmd.AddCommand(cmdFlatten)
-	cmdFlatten.PersistentFlags().BoolVar(&SkipBinaryFiles, "skip-binary-files", true, "Skip binary files")
+	cmdFlatten.PersistentFlags().BoolVar(&SkipBinaryFiles, "skip-binary-files", true, "Skip binary files, otherwise they are base64 encoded")
+	cmdFlatten.PersistentFlags().StringArrayVar(&BinaryGlobs, "binary-globs", []string{}, "Binary files to include (base64 encoded) even with --skip-binary-files")
+	cmdFlatten.PersistentFlags().Int64Var(&MaxFileSize, "max-file-size", 0, "Apply --file-size-policy to files larger than this many bytes, 0 means unlimited")
+	cmdFlatten.PersistentFlags().StringVar(&FileSizePolicy, "file-size-policy", SizePolicySkip, "What to do with files larger than --max-file-size (skip, truncate-head, truncate-middle, error)")
+	cmdFlatten.PersistentFlags().Int64Var(&MaxBinarySize, "max-binary-size", 1<<20, "Skip binary files larger than this many bytes, 0 means unlimited")
 	cmdFlatten.PersistentFlags().BoolVar(&LLM, "llm", false, "Output in LLM prompt format")
+	cmdFlatten.PersistentFlags().StringVar(&Prompt, "prompt", "", "Task to put into the LLM prompt (implies --llm)")
+	cmdFlatten.PersistentFlags().StringVar(&PromptFile, "prompt-file", "", "Read the task for the LLM prompt from a file, - for stdin (implies --llm)")
+	cmdFlatten.PersistentFlags().StringVar(&TemplateFile, "template", "", "Go text/template for the LLM prompt, defaults to a .flattenprompt next to .flattenignore (implies --llm)")
+	cmdFlatten.PersistentFlags().StringVar(&TokenizerName, "tokenizer", "approx", "Tokenizer used to estimate tokens (approx, chars)")
+	cmdFlatten.PersistentFlags().IntVar(&MaxTokens, "max-tokens", 0, "Token budget of the whole output, 0 means unlimited")
+	cmdFlatten.PersistentFlags().StringVar(&BudgetPolicy, "budget-policy", BudgetPolicyError, "What to do if --max-tokens is exceeded (error, drop-largest, drop-deepest)")
+	cmdFlatten.PersistentFlags().StringArrayVar(&PriorityGlobs, "priority-globs", []string{}, "Files to drop last when over budget, earlier globs have a higher priority")
+	cmdFlatten.PersistentFlags().BoolVar(&TokenReport, "token-report", false, "Print the estimated tokens per file to stderr")
+	cmdFlatten.PersistentFlags().BoolVar(&Redact, "redact", false, "Mask secrets (built-in detectors and .flattenredact regexes) even without --llm")
+	cmdFlatten.PersistentFlags().BoolVar(&NoRedact, "no-redact", false, "Do not mask secrets in LLM prompts")
+	cmdFlatten.PersistentFlags().BoolVar(&NoHash, "no-hash", false, "Do not record content hashes (expand can't detect conflicts then)")
+	cmdFlatten.PersistentFlags().BoolVar(&Metadata, "metadata", false, "Record the size and mtime of every file")
+	cmdFlatten.PersistentFlags().StringVar(&OutputFormat, "format", FormatYAML, "Output format (yaml, json, jsonl, md, tar, tar.gz, zip)")
 	cmdFlatten.PersistentFlags().StringArrayVar(&IgnoredGlobs, "ignored-globs", []string{".git/", ".task/", "node_modules/"}, "IgnoredGlobs (Blocklist)")
 	cmdFlatten.PersistentFlags().StringArrayVar(&AllowedGlobs, "allowed-globs", []string{}, "AllowedGlobs (Allowlist)")
+	cmdFlatten.PersistentFlags().StringVar(&Rev, "rev", "", "Flatten the files of this git revision instead of the working directory")
+	cmdFlatten.PersistentFlags().BoolVar(&GitTracked, "git-tracked", false, "Only flatten files tracked by git (plus the .flattenallow/--allowed-globs files)")
+	cmdFlatten.PersistentFlags().StringVar(&GitChanged, "git-changed", "", "Only flatten files changed since this git ref, including untracked ones (plus the .flattenallow/--allowed-globs files)")
+	cmdFlatten.PersistentFlags().BoolVar(&GitStaged, "git-staged", false, "Only flatten files staged in git (plus the .flattenallow/--allowed-globs files)")
+	cmdFlatten.PersistentFlags().BoolVar(&NoGitignore, "no-gitignore", false, "Do not honor .gitignore files and .git/info/exclude")
+	cmdFlatten.PersistentFlags().BoolVar(&AllowOutsideRoot, "allow-outside-root", false, "Key files outside the working directory by their absolute path")
+	cmdFlatten.PersistentFlags().BoolVar(&FollowSymlinks, "follow-symlinks", false, "Inline the files symlinks point to instead of recording the links")
+	cmdFlatten.PersistentFlags().IntVar(&Jobs, "jobs", runtime.NumCPU(), "Number of files to read in parallel")
 	cmdFlatten.PersistentFlags().BoolVar(&NoIgnores, "no-ignores", false, "Do not apply any ignores/allow filtering in flatten mode; only flatten the listed files/dirs")
+	cmdFlatten.PersistentFlags().StringVarP(&OutputPath, "output", "o", "+", "Write to this file instead of stdout")
+	cmdFlatten.PersistentFlags().BoolVar(&Watch, "watch", false, "Keep the --output file in sync, flatten again whenever the selected files change")
+	cmdFlatten.PersistentFlags().BoolVar(&WatchPoll, "watch-poll", false, "Poll for changes with --watch even where the OS can notify about them")
+	cmdFlatten.PersistentFlags().DurationVar(&WatchInterval, "watch-interval", time.Second, "How often to poll for changes with --watch")
+	cmdFlatten.PersistentFlags().DurationVar(&WatchDebounce, "watch-debounce", 200*time.Millisecond, "How long it has to be quiet after a change before flattening again")
+	Cmd.AddCommand(cmdLs)
+	// the selection flags of flatten, shared so ls picks exactly the same files
+	for _, name := range []string{"skip-binary-files", "binary-globs", "max-binary-size", "max-file-size", "file-size-policy",
+		"tokenizer", "ignored-globs", "allowed-globs", "git-tracked", "git-changed", "git-staged", "no-gitignore",
+		"allow-outside-root", "follow-symlinks", "no-ignores"} {
+		cmdLs.PersistentFlags().AddFlag(cmdFlatten.PersistentFlags().Lookup(name))
+	}
 	Cmd.AddCommand(cmdExpand)
+	cmdExpand.PersistentFlags().BoolVar(&DryRun, "dry-run", false, "Only print a diff of what would change, exit with 1 if anything would")
+	cmdExpand.PersistentFlags().BoolVar(&Interactive, "interactive", false, "Show the diff of every changed file and ask whether to apply it")
+	cmdExpand.PersistentFlags().StringVar(&OnConflict, "on-conflict", ConflictRefuse, "What to do with files that changed since they were flattened (refuse, merge, overwrite)")
+	cmdExpand.PersistentFlags().StringVar(&BasePath, "base", "", "The flattened snapshot, used as the merge base for --on-conflict merge")
+	cmdExpand.PersistentFlags().BoolVar(&AllowOutsideRoot, "allow-outside-root", false, "Allow absolute paths, .. and symlinks to write or point outside of the output root")
+	cmdExpand.PersistentFlags().BoolVar(&NoColor, "no-color", false, "Do not color diffs")
+	cmdExpand.PersistentFlags().BoolVar(&PreserveTimes, "preserve-times", false, "Restore the mtimes recorded with flatten --metadata")
+	cmdExpand.PersistentFlags().StringVar(&InputFormat, "format", "", "Input format (yaml, json, jsonl, md, tar, tar.gz, zip), detected if empty")
+	Cmd.AddCommand(cmdApply)
+	cmdApply.PersistentFlags().BoolVar(&DryRun, "dry-run", false, "Only print a diff of what would change, exit with 1 if anything would")
+	cmdApply.PersistentFlags().BoolVar(&Interactive, "interactive", false, "Show the diff of every changed file and ask whether to apply it")
+	cmdApply.PersistentFlags().BoolVar(&AllowOutsideRoot, "allow-outside-root", false, "Allow absolute paths and .. to write outside of the output root")
+	cmdApply.PersistentFlags().BoolVar(&NoColor, "no-color", false, "Do not color diffs")
+	cmdApply.PersistentFlags().BoolVar(&Partial, "partial", false, "Write the hunks of a file that apply even if others of it fail, otherwise the file is left unchanged")
+	cmdApply.PersistentFlags().IntVar(&Fuzz, "fuzz", 2, "Number of context lines at the start and end of a hunk that may be ignored if it doesn't match")
+	Cmd.AddCommand(cmdDiff)
+	cmdDiff.PersistentFlags().StringVar(&DiffMode, "mode", DiffModeSummary, "What to print (summary, unified, delta), delta can be fed to expand")
+	cmdDiff.PersistentFlags().StringVar(&OutputFormat, "format", FormatYAML, "Format of the delta (yaml, json, jsonl, md)")
+	cmdDiff.PersistentFlags().BoolVar(&NoColor, "no-color", false, "Do not color diffs")
+	// directories are flattened like flatten does, pass the options the snapshot was made with
+	for _, name := range []string{"skip-binary-files", "binary-globs", "max-binary-size", "max-file-size", "file-size-policy",
+		"ignored-globs", "allowed-globs", "no-gitignore", "follow-symlinks"} {
+		cmdDiff.PersistentFlags().AddFlag(cmdFlatten.PersistentFlags().Lookup(name))
+	}
+	Cmd.AddCommand(cmdServe)
+	cmdServe.PersistentFlags().StringVar(&ServeAddr, "addr", "127.0.0.1:8080", "Address to listen on")
+	cmdServe.PersistentFlags().StringVar(&ServeToken, "token", "", "Require this bearer token (Authorization: Bearer <token>)")
+	cmdServe.PersistentFlags().StringVar(&ServeTokenFile, "token-file", "", "Read the bearer token from this file")
+	cmdServe.PersistentFlags().StringArrayVar(&ServeOrigins, "allow-origin", []string{}, "Browser origin (e.g. of an extension) allowed to call the API, others are refused")
+	cmdServe.PersistentFlags().Int64Var(&ServeMaxBody, "max-body", 64<<20, "Largest tree expand accepts, in bytes")
+	Cmd.AddCommand(cmdVerify)
+	cmdVerify.PersistentFlags().StringVar(&InputFormat, "format", "", "Snapshot format (yaml, json, jsonl, md, tar, tar.gz, zip), detected if empty")
 }
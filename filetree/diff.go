@@ -0,0 +1,267 @@
+package filetree
+
+import (
+	"fmt"
+	"strings"
+)
+
+const diffContext = 3
+
+// diffOp is a single line of a diff, Kind is ' ', '-' or '+'
+type diffOp struct {
+	Kind byte
+	Line string // including its "\n", the last line of a file may not have one
+}
+
+// splitLines splits text into lines that keep their "\n"
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffLines computes a shortest edit script from a to b, deletions come
+// before insertions in every change. Lines only one side has can't match, they
+// are left out of the search so a rewritten file is cheap.
+func diffLines(a, b []string) []diffOp {
+	ids := map[string]int{}
+	number := func(lines []string) []int {
+		nums := make([]int, len(lines))
+		for i, line := range lines {
+			id, ok := ids[line]
+			if !ok {
+				id = len(ids)
+				ids[line] = id
+			}
+			nums[i] = id
+		}
+		return nums
+	}
+	na, nb := number(a), number(b)
+	inA, inB := make([]bool, len(ids)), make([]bool, len(ids))
+	for _, id := range na {
+		inA[id] = true
+	}
+	for _, id := range nb {
+		inB[id] = true
+	}
+	m := &myers{}
+	var ia, ib []int // where the lines of m.a and m.b are in a and b
+	for i, id := range na {
+		if inB[id] {
+			m.a, ia = append(m.a, id), append(ia, i)
+		}
+	}
+	for j, id := range nb {
+		if inA[id] {
+			m.b, ib = append(m.b, id), append(ib, j)
+		}
+	}
+	m.off = (len(m.a)+len(m.b)+1)/2 + 1
+	m.vf, m.vb = make([]int, 2*m.off+1), make([]int, 2*m.off+1)
+	m.compare(0, len(m.a), 0, len(m.b))
+
+	var ops []diffOp
+	i, j := 0, 0
+	for _, match := range m.matches {
+		for ; i < ia[match[0]]; i++ {
+			ops = append(ops, diffOp{'-', a[i]})
+		}
+		for ; j < ib[match[1]]; j++ {
+			ops = append(ops, diffOp{'+', b[j]})
+		}
+		ops = append(ops, diffOp{' ', a[i]})
+		i++
+		j++
+	}
+	for ; i < len(a); i++ {
+		ops = append(ops, diffOp{'-', a[i]})
+	}
+	for ; j < len(b); j++ {
+		ops = append(ops, diffOp{'+', b[j]})
+	}
+	return ops
+}
+
+// myers is Myers' linear space algorithm, it finds the longest common
+// subsequence of a and b
+type myers struct {
+	a, b    []int
+	vf, vb  []int // furthest x on every diagonal, forwards and backwards
+	off     int   // index of diagonal 0 in vf and vb
+	matches [][2]int
+}
+
+// compare adds the matching lines of a[aLo:aHi] and b[bLo:bHi] in order
+func (m *myers) compare(aLo, aHi, bLo, bHi int) {
+	for aLo < aHi && bLo < bHi && m.a[aLo] == m.b[bLo] {
+		m.matches = append(m.matches, [2]int{aLo, bLo})
+		aLo++
+		bLo++
+	}
+	suffix := 0
+	for aLo < aHi && bLo < bHi && m.a[aHi-1] == m.b[bHi-1] {
+		aHi--
+		bHi--
+		suffix++
+	}
+	if aLo < aHi && bLo < bHi {
+		// without a common prefix or suffix it takes at least 2 edits, both
+		// halves take fewer
+		x, y, u, v := m.middleSnake(aLo, aHi, bLo, bHi)
+		m.compare(aLo, x, bLo, y)
+		for ; x < u; x, y = x+1, y+1 {
+			m.matches = append(m.matches, [2]int{x, y})
+		}
+		m.compare(u, aHi, v, bHi)
+	}
+	for i := range suffix {
+		m.matches = append(m.matches, [2]int{aHi + i, bHi + i})
+	}
+}
+
+// middleSnake returns the snake (x, y) to (u, v) in the middle of a shortest
+// edit script, searching from both ends at once
+func (m *myers) middleSnake(aLo, aHi, bLo, bHi int) (x, y, u, v int) {
+	n, mm := aHi-aLo, bHi-bLo
+	delta := n - mm
+	odd := delta%2 != 0
+	vf, vb, off := m.vf, m.vb, m.off
+	vf[off+1], vb[off+1] = 0, 0
+	for d := 0; d <= (n+mm+1)/2; d++ {
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && vf[off+k-1] < vf[off+k+1]) {
+				x = vf[off+k+1] // down: insertion
+			} else {
+				x = vf[off+k-1] + 1 // right: deletion
+			}
+			y := x - k
+			x0, y0 := x, y
+			for x < n && y < mm && m.a[aLo+x] == m.b[bLo+y] {
+				x++
+				y++
+			}
+			vf[off+k] = x
+			if kb := delta - k; odd && kb >= -(d-1) && kb <= d-1 && x+vb[off+kb] >= n {
+				return aLo + x0, bLo + y0, aLo + x, bLo + y
+			}
+		}
+		// backwards x and y count from the ends
+		for kb := -d; kb <= d; kb += 2 {
+			var x int
+			if kb == -d || (kb != d && vb[off+kb-1] < vb[off+kb+1]) {
+				x = vb[off+kb+1]
+			} else {
+				x = vb[off+kb-1] + 1
+			}
+			y := x - kb
+			x0, y0 := x, y
+			for x < n && y < mm && m.a[aHi-1-x] == m.b[bHi-1-y] {
+				x++
+				y++
+			}
+			vb[off+kb] = x
+			if k := delta - kb; !odd && k >= -d && k <= d && x+vf[off+k] >= n {
+				return aHi - x, bHi - y, aHi - x0, bHi - y0
+			}
+		}
+	}
+	panic("diff: no middle snake") // unreachable, d reaches (n+m)/2
+}
+
+// unifiedHunks returns the "@@ ... @@" hunks between two texts, colorize
+// wraps each line in the given color (see diffColor)
+func unifiedHunks(oldText, newText string, colorize func(kind byte, line string) string) string {
+	ops := diffLines(splitLines(oldText), splitLines(newText))
+
+	var changes []int
+	for i, op := range ops {
+		if op.Kind != ' ' {
+			changes = append(changes, i)
+		}
+	}
+	if len(changes) == 0 {
+		return ""
+	}
+
+	// line numbers before every op
+	oldLine := make([]int, len(ops)+1)
+	newLine := make([]int, len(ops)+1)
+	for i, op := range ops {
+		oldLine[i+1], newLine[i+1] = oldLine[i], newLine[i]
+		if op.Kind != '+' {
+			oldLine[i+1]++
+		}
+		if op.Kind != '-' {
+			newLine[i+1]++
+		}
+	}
+
+	var out strings.Builder
+	for c := 0; c < len(changes); {
+		start := changes[c] - diffContext
+		if start < 0 {
+			start = 0
+		}
+		last := changes[c]
+		for c+1 < len(changes) && changes[c+1]-last <= 2*diffContext {
+			c++
+			last = changes[c]
+		}
+		c++
+		end := last + diffContext + 1
+		if end > len(ops) {
+			end = len(ops)
+		}
+
+		oldCount := oldLine[end] - oldLine[start]
+		newCount := newLine[end] - newLine[start]
+		out.WriteString(colorize('@', fmt.Sprintf("@@ -%s +%s @@",
+			hunkRange(oldLine[start], oldCount), hunkRange(newLine[start], newCount))) + "\n")
+		for _, op := range ops[start:end] {
+			line := string(op.Kind) + strings.TrimSuffix(op.Line, "\n")
+			out.WriteString(colorize(op.Kind, line) + "\n")
+			if !strings.HasSuffix(op.Line, "\n") {
+				out.WriteString("\\ No newline at end of file\n")
+			}
+		}
+	}
+	return out.String()
+}
+
+// hunkRange formats the start,count of a hunk header
+func hunkRange(start int, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+// diffColor returns a colorize func for unifiedHunks, color false disables it
+func diffColor(color bool) func(kind byte, line string) string {
+	return func(kind byte, line string) string {
+		if !color {
+			return line
+		}
+		switch kind {
+		case '-':
+			return "\x1b[31m" + line + "\x1b[0m"
+		case '+':
+			return "\x1b[32m" + line + "\x1b[0m"
+		case '@':
+			return "\x1b[36m" + line + "\x1b[0m"
+		case 'h':
+			return "\x1b[1m" + line + "\x1b[0m"
+		}
+		return line
+	}
+}
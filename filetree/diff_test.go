@@ -0,0 +1,141 @@
+package filetree
+
+import (
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// lcsLength is the length of the longest common subsequence, the number of
+// unchanged lines of a shortest edit script
+func lcsLength(a, b []string) int {
+	prev, cur := make([]int, len(b)+1), make([]int, len(b)+1)
+	for i := range a {
+		for j := range b {
+			if a[i] == b[j] {
+				cur[j+1] = prev[j] + 1
+			} else {
+				cur[j+1] = max(cur[j], prev[j+1])
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// checkDiff checks that ops turn a into b with as few changes as possible and
+// that deletions come before insertions
+func checkDiff(t *testing.T, a, b []string, ops []diffOp) {
+	t.Helper()
+	var gotA, gotB []string
+	same := 0
+	for i, op := range ops {
+		switch op.Kind {
+		case ' ':
+			gotA, gotB = append(gotA, op.Line), append(gotB, op.Line)
+			same++
+		case '-':
+			gotA = append(gotA, op.Line)
+			if i > 0 && ops[i-1].Kind == '+' {
+				t.Fatalf("deletion after an insertion at op %d", i)
+			}
+		case '+':
+			gotB = append(gotB, op.Line)
+		}
+	}
+	if strings.Join(gotA, "") != strings.Join(a, "") || strings.Join(gotB, "") != strings.Join(b, "") {
+		t.Fatalf("ops don't turn %q into %q: %v", a, b, ops)
+	}
+	if want := lcsLength(a, b); same != want {
+		t.Fatalf("%d unchanged lines, the shortest edit script has %d", same, want)
+	}
+}
+
+func TestDiffLinesRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	lines := func() []string {
+		n := r.Intn(30)
+		alphabet := 1 + r.Intn(6)
+		out := make([]string, n)
+		for i := range out {
+			out[i] = fmt.Sprintf("%c\n", 'a'+r.Intn(alphabet))
+		}
+		return out
+	}
+	for range 2000 {
+		a, b := lines(), lines()
+		checkDiff(t, a, b, diffLines(a, b))
+	}
+}
+
+// A file that is rewritten completely used to take memory quadratic in its
+// length
+func TestDiffLinesRewrite(t *testing.T) {
+	var a, b []string
+	for i := range 15000 {
+		a = append(a, fmt.Sprintf("old %d\n", i))
+		b = append(b, fmt.Sprintf("new %d\n", i))
+	}
+	ops := diffLines(a, b)
+	if len(ops) != 30000 || ops[0].Kind != '-' || ops[15000].Kind != '+' {
+		t.Fatalf("unexpected ops: %d", len(ops))
+	}
+
+	// interleaved with the same lines, nothing can be left out of the search
+	a, b = a[:0], b[:0]
+	for i := range 5000 {
+		a = append(a, fmt.Sprintf("%d\n", i%7), "x\n")
+		b = append(b, fmt.Sprintf("%d\n", i%5), "x\n")
+	}
+	ops = diffLines(a, b)
+	same := 0
+	for _, op := range ops {
+		if op.Kind == ' ' {
+			same++
+		}
+	}
+	if same < 5000 {
+		t.Fatalf("only %d unchanged lines", same)
+	}
+}
+
+// A snapshot compared with the directory it was made of has no changes, with
+// binary files and a .flattenignore that must not leak into the other side
+func TestDiffSnapshotAgainstSource(t *testing.T) {
+	src := t.TempDir()
+	writeTestFiles(t, src, map[string]string{
+		".flattenignore": "*.log\n",
+		"a.txt":          "hello\n",
+		"b.log":          "skipped\n",
+		"img.bin":        "\x00\x01\x02binary",
+	})
+	defer keep(&IgnoredGlobs)()
+	defer keep(&AllowedGlobs)()
+	IgnoredGlobs = []string{".git/"}
+
+	snapshot := filepath.Join(t.TempDir(), "snapshot.yaml")
+	if _, err := findRootAndPopulateFromDotFlattenFile(src); err != nil {
+		t.Fatal(err)
+	}
+	if err := DirTreeToYAML(src, snapshot, []string{}, true); err != nil {
+		t.Fatal(err)
+	}
+	IgnoredGlobs = []string{".git/"}
+
+	a, err := loadTree(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := loadTree(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changes := diffTrees(a, b); len(changes) != 0 {
+		t.Errorf("unexpected changes: %v", changes)
+	}
+	if len(IgnoredGlobs) != 1 || IgnoredGlobs[0] != ".git/" {
+		t.Errorf("loadTree left IgnoredGlobs at %q", IgnoredGlobs)
+	}
+}
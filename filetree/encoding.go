@@ -0,0 +1,82 @@
+package filetree
+
+import (
+	"encoding/base64"
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/mrvnmyr/oat/common"
+)
+
+const (
+	EncodingUTF8   = "utf8"
+	EncodingBase64 = "base64"
+)
+
+var (
+	// BinaryGlobs are binary files that are flattened (base64 encoded) even
+	// with SkipBinaryFiles
+	BinaryGlobs []string = []string{}
+
+	// MaxBinarySize skips larger binary files, 0 means unlimited
+	MaxBinarySize int64 = 1 << 20
+)
+
+// includeBinary returns true if the binary file relPath of size bytes is
+// flattened
+func includeBinary(relPath string, size int64) bool {
+	return binaryExcludeReason(relPath, size) == ""
+}
+
+// binaryExcludeReason returns why the binary file relPath of size bytes is
+// skipped, "" if it isn't
+func binaryExcludeReason(relPath string, size int64) string {
+	if MaxBinarySize > 0 && size > MaxBinarySize {
+		common.Debugf("Skipping %s, binary files are limited to %d bytes\n", relPath, MaxBinarySize)
+		return fmt.Sprintf("binary, larger than --max-binary-size %d", MaxBinarySize)
+	}
+	if !SkipBinaryFiles {
+		return ""
+	}
+	if included, _ := cachedIgnoreMatcher(BinaryGlobs).match(relPath, false); !included {
+		return "binary, not matched by --binary-globs"
+	}
+	return ""
+}
+
+// contentEntry returns the entry for a file's content, anything that isn't
+// valid UTF-8 text is base64 encoded
+func contentEntry(perm string, b []byte) Entry {
+	if isLikelyBinary(b) || !utf8.Valid(b) {
+		return Entry{
+			Perm:     perm,
+			Encoding: EncodingBase64,
+			Content:  base64.StdEncoding.EncodeToString(b),
+		}
+	}
+	return Entry{
+		Perm:    perm,
+		Content: string(b),
+	}
+}
+
+// isBase64 returns true if the content is base64 encoded
+func (e Entry) isBase64() bool {
+	return e.Encoding == EncodingBase64
+}
+
+// decodedContent returns the content as it is written to disk
+func (e Entry) decodedContent() (string, error) {
+	switch e.Encoding {
+	case "", EncodingUTF8:
+		return e.Content, nil
+	case EncodingBase64:
+		b, err := base64.StdEncoding.DecodeString(e.Content)
+		if err != nil {
+			return "", fmt.Errorf("invalid base64 content: %w", err)
+		}
+		return string(b), nil
+	default:
+		return "", fmt.Errorf("unknown encoding %q", e.Encoding)
+	}
+}
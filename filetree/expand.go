@@ -0,0 +1,637 @@
+package filetree
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	// DryRun only prints what expand would change
+	DryRun bool = false
+
+	// Interactive asks before every changed file is written
+	Interactive bool = false
+
+	// NoColor disables colored diffs
+	NoColor bool = false
+)
+
+// ErrChangesPending is returned by a dry run that would change files
+var ErrChangesPending = errors.New("expand would change files")
+
+// ErrMergeConflicts is returned if a merge left conflict markers in files
+var ErrMergeConflicts = errors.New("unresolved merge conflicts")
+
+const (
+	changeNone   = "unchanged"
+	changeAdd    = "new"
+	changeModify = "modified"
+	changePerm   = "perm"
+	changeDelete = "deleted"
+	changeRename = "renamed"
+)
+
+// fileChange is what expand does to a single file
+type fileChange struct {
+	Path  string // key in the tree
+	Full  string // path on disk
+	Root  string // the output root
+	Kind  string
+	Entry Entry
+	Perm  os.FileMode // perm that will be set
+
+	From     string // key of the renamed file
+	FromFull string // path of the renamed file on disk
+
+	OldContent string // of the file at Full, or at FromFull for renames
+	OldPerm    os.FileMode
+
+	Conflict  string // why the file on disk doesn't match Entry.Hash
+	Conflicts int    // conflict blocks written by a merge
+
+	Skip string // why the entry isn't written
+}
+
+// planExpand compares tree with the files below destRoot, base is the
+// flattened snapshot (may be nil) that conflicts are merged against
+func planExpand(tree map[string]Entry, destRoot string, base map[string]Entry) ([]fileChange, error) {
+	if err := checkTreeLinks(tree); err != nil {
+		return nil, err
+	}
+	if err := checkRenames(tree); err != nil {
+		return nil, err
+	}
+	var changes []fileChange
+	for _, p := range sortedPaths(tree) {
+		entry := tree[p]
+		switch entry.Type {
+		case "":
+			content, err := entry.decodedContent()
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", p, err)
+			}
+			entry.Content, entry.Encoding = content, ""
+		case EntryTypeSymlink:
+			if err := checkSymlinkTarget(p, entry.Target); err != nil {
+				return nil, err
+			}
+			entry.Content = entry.Target // like in git, diffs show the target
+		default:
+			return nil, fmt.Errorf("%s: unknown type %q", p, entry.Type)
+		}
+		full, err := resolveDest(destRoot, p)
+		if err != nil {
+			return nil, err
+		}
+		c := fileChange{
+			Path:  p,
+			Full:  full,
+			Root:  destRoot,
+			Entry: entry,
+		}
+		if entry.Delete && entry.RenamedFrom != "" {
+			return nil, fmt.Errorf("%s: delete and renamed_from can't be combined", p)
+		}
+		if entry.Truncated {
+			if entry.RenamedFrom == "" {
+				// never write a cut short file over the real one
+				c.Kind = changeNone
+				c.Skip = "truncated by flatten"
+				changes = append(changes, c)
+				continue
+			}
+			c.Entry.Content = "" // only move the file
+			entry = c.Entry
+		}
+
+		source := c.Full
+		if entry.RenamedFrom != "" {
+			c.From = entry.RenamedFrom
+			c.FromFull, err = resolveDest(destRoot, entry.RenamedFrom)
+			if err != nil {
+				return nil, err
+			}
+			source = c.FromFull
+			if _, err := os.Lstat(c.Full); err == nil {
+				return nil, fmt.Errorf("%s: refusing to rename %s over an existing file", p, entry.RenamedFrom)
+			}
+		}
+
+		exists, err := c.readOld(source)
+		if err != nil {
+			return nil, err
+		}
+		if !entry.isSymlink() && keepsTruncation(c.Entry.Content, c.OldContent) {
+			// the hash is the one of the whole file, so only the content
+			// tells that it was cut short
+			c.Kind = changeNone
+			c.Skip = "still has the truncation line of flatten"
+			changes = append(changes, c)
+			continue
+		}
+		if !entry.isSymlink() && rePlaceholder.MatchString(c.Entry.Content) {
+			rules, err := loadRedactRules(destRoot)
+			if err != nil {
+				return nil, err
+			}
+			restored, err := restoreSecrets(c.Entry.Content, c.OldContent, redactRulesFor(p, rules))
+			if err != nil {
+				// never write a placeholder over a real secret
+				c.Kind = changeNone
+				c.Skip = "has redacted secrets, " + err.Error()
+				changes = append(changes, c)
+				continue
+			}
+			c.Entry.Content = restored
+		}
+		switch {
+		case !exists && entry.Delete:
+			c.Kind = changeNone // already gone
+			changes = append(changes, c)
+			continue
+		case !exists && entry.RenamedFrom != "":
+			return nil, fmt.Errorf("%s: renamed_from %s doesn't exist", p, entry.RenamedFrom)
+		case !exists:
+			c.Kind = changeAdd
+		case entry.Delete:
+			c.Kind = changeDelete
+		case entry.RenamedFrom != "" && entry.Content == "" && !entry.isSymlink():
+			c.Entry.Content = c.OldContent // a plain rename
+			if c.OldPerm&os.ModeSymlink != 0 {
+				c.Entry.Type = EntryTypeSymlink
+				c.Entry.Target = c.OldContent
+			}
+		}
+
+		c.Perm = c.OldPerm
+		if c.Entry.isSymlink() {
+			c.Perm = os.ModeSymlink
+		} else if entry.Perm != "" && !entry.Delete {
+			perm, err := parsePerm(entry.Perm)
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid perm %q: %w", p, entry.Perm, err)
+			}
+			c.Perm = perm.Perm()
+		} else if c.Kind == changeAdd || c.OldPerm&os.ModeSymlink != 0 && !entry.Delete {
+			c.Perm = 0o644
+		}
+
+		// replies often come without the hashes, Markdown has none at all
+		hash := entry.Hash
+		if hash == "" {
+			basePath := p
+			if entry.RenamedFrom != "" {
+				basePath = entry.RenamedFrom
+			}
+			if b, ok := base[basePath]; ok && !b.Delete {
+				hash = entryHash(b)
+			}
+		}
+		if hash != "" {
+			if err := c.checkConflict(base, hash); err != nil {
+				return nil, err
+			}
+		}
+
+		if c.Kind == "" {
+			switch {
+			case entry.RenamedFrom != "":
+				c.Kind = changeRename
+			case c.OldContent != c.Entry.Content:
+				c.Kind = changeModify
+			case c.OldPerm != c.Perm:
+				c.Kind = changePerm
+			default:
+				c.Kind = changeNone
+			}
+		}
+		changes = append(changes, c)
+	}
+	return changes, nil
+}
+
+// checkRenames rejects renames that depend on each other or on the order they
+// are applied in: a file renamed twice, or renamed and written or deleted
+func checkRenames(tree map[string]Entry) error {
+	renamedTo := map[string]string{}
+	for _, p := range sortedPaths(tree) {
+		from := tree[p].RenamedFrom
+		if from == "" {
+			continue
+		}
+		if other, ok := renamedTo[from]; ok {
+			return fmt.Errorf("%s: %s is renamed to %s already", p, from, other)
+		}
+		if _, ok := tree[from]; ok {
+			return fmt.Errorf("%s: %s is renamed and has an entry of its own", p, from)
+		}
+		renamedTo[from] = p
+	}
+	return nil
+}
+
+// readOld reads the current content and perm of the file at full, for
+// symlinks that's the target and os.ModeSymlink
+func (c *fileChange) readOld(full string) (bool, error) {
+	info, err := os.Lstat(full)
+	switch {
+	case os.IsNotExist(err):
+		return false, nil
+	case err != nil:
+		return false, err
+	case info.IsDir():
+		return false, fmt.Errorf("%s: is a directory", full)
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(full)
+		if err != nil {
+			return false, err
+		}
+		c.OldContent = filepath.ToSlash(target)
+		c.OldPerm = os.ModeSymlink
+		return true, nil
+	}
+	b, err := os.ReadFile(full)
+	if err != nil {
+		return false, err
+	}
+	c.OldContent = string(b)
+	c.OldPerm = info.Mode().Perm()
+	return true, nil
+}
+
+// checkConflict compares the file on disk with hash, the one it had when it
+// was flattened, and resolves a mismatch according to OnConflict. A file that
+// doesn't exist is just added, the snapshot may be expanded somewhere else.
+func (c *fileChange) checkConflict(base map[string]Entry, hash string) error {
+	switch {
+	case c.Kind == changeAdd:
+		return nil
+	case c.Kind != changeDelete && c.OldContent == c.Entry.Content:
+		return nil // already up to date
+	case contentHash(c.OldContent) != hash:
+		c.Conflict = "changed since it was flattened"
+	default:
+		return nil
+	}
+
+	switch OnConflict {
+	case ConflictRefuse, ConflictOverwrite:
+	case ConflictMerge:
+		if c.Kind == changeDelete {
+			c.Kind = changeNone // keep the local changes
+			return nil
+		}
+		if c.isBinary() {
+			return fmt.Errorf("%s: %s, binary files can't be merged", c.Path, c.Conflict)
+		}
+		basePath := c.Path
+		if c.From != "" {
+			basePath = c.From
+		}
+		baseContent := ""
+		if b, ok := base[basePath]; ok {
+			if content, err := b.decodedContent(); err == nil && contentHash(content) == hash {
+				baseContent = content
+			}
+		}
+		c.Entry.Content, c.Conflicts = merge3(baseContent, c.OldContent, c.Entry.Content)
+	default:
+		return fmt.Errorf("unknown conflict policy: %s", OnConflict)
+	}
+	return nil
+}
+
+// diff renders the change as a git style unified diff
+func (c fileChange) diff(color bool) string {
+	colorize := diffColor(color)
+
+	oldPath := c.Path
+	if c.From != "" {
+		oldPath = c.From
+	}
+
+	var out strings.Builder
+	out.WriteString(colorize('h', fmt.Sprintf("diff --git a/%s b/%s", oldPath, c.Path)) + "\n")
+	switch {
+	case c.Kind == changeAdd:
+		out.WriteString(colorize('h', fmt.Sprintf("new file mode %s", gitMode(c.Perm))) + "\n")
+	case c.Kind == changeDelete:
+		out.WriteString(colorize('h', fmt.Sprintf("deleted file mode %s", gitMode(c.OldPerm))) + "\n")
+	case c.OldPerm != c.Perm:
+		out.WriteString(colorize('h', fmt.Sprintf("old mode %s", gitMode(c.OldPerm))) + "\n")
+		out.WriteString(colorize('h', fmt.Sprintf("new mode %s", gitMode(c.Perm))) + "\n")
+	}
+	if c.From != "" {
+		out.WriteString(colorize('h', "rename from "+c.From) + "\n")
+		out.WriteString(colorize('h', "rename to "+c.Path) + "\n")
+	}
+
+	newContent := c.Entry.Content
+	if c.Kind == changeDelete {
+		newContent = ""
+	}
+	oldName := "a/" + oldPath
+	if c.Kind == changeAdd {
+		oldName = "/dev/null"
+	}
+	newName := "b/" + c.Path
+	if c.Kind == changeDelete {
+		newName = "/dev/null"
+	}
+	if c.isBinary() {
+		if c.OldContent != newContent {
+			out.WriteString(fmt.Sprintf("Binary files %s and %s differ\n", oldName, newName))
+		}
+		return out.String()
+	}
+	hunks := unifiedHunks(c.OldContent, newContent, colorize)
+	if hunks != "" {
+		out.WriteString(colorize('h', "--- "+oldName) + "\n")
+		out.WriteString(colorize('h', "+++ "+newName) + "\n")
+		out.WriteString(hunks)
+	}
+	return out.String()
+}
+
+// isBinary returns true if the old or new content is binary
+func (c fileChange) isBinary() bool {
+	return isLikelyBinary([]byte(c.OldContent)) || isLikelyBinary([]byte(c.Entry.Content))
+}
+
+// gitMode formats a perm like git does in diffs, but keeps all perm bits
+func gitMode(perm os.FileMode) string {
+	if perm&os.ModeSymlink != 0 {
+		return "120000"
+	}
+	return fmt.Sprintf("100%03o", perm.Perm())
+}
+
+// recheck resolves the paths of the change again, the changes applied before
+// it may have put a symlink where a directory was when it was planned
+func (c fileChange) recheck() error {
+	for _, p := range []string{c.Path, c.From} {
+		if p == "" {
+			continue
+		}
+		if _, err := resolveDest(c.Root, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyOrder returns changes in the order they are applied: renames first,
+// before anything is written where their files were, and symlinks last, so
+// nothing is written through a link the tree creates
+func applyOrder(changes []fileChange) []fileChange {
+	rank := func(c fileChange) int {
+		switch {
+		case c.Kind == changeRename:
+			return 0
+		case c.Entry.isSymlink():
+			return 2
+		}
+		return 1
+	}
+	ordered := append([]fileChange{}, changes...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return rank(ordered[i]) < rank(ordered[j])
+	})
+	return ordered
+}
+
+// apply writes the change to disk
+func (c fileChange) apply() error {
+	if err := c.recheck(); err != nil {
+		return err
+	}
+	switch c.Kind {
+	case changeNone:
+		return c.restoreTime()
+	case changeDelete:
+		return os.Remove(c.Full)
+	}
+	if err := os.MkdirAll(filepath.Dir(c.Full), 0o755); err != nil {
+		return err
+	}
+	if c.Kind == changeRename {
+		if err := os.Rename(c.FromFull, c.Full); err != nil {
+			return err
+		}
+	}
+	oldLink := c.Kind != changeAdd && c.OldPerm&os.ModeSymlink != 0
+	if c.Entry.isSymlink() {
+		if oldLink && c.OldContent == c.Entry.Target {
+			return nil
+		}
+		if c.Kind != changeAdd {
+			if err := os.Remove(c.Full); err != nil {
+				return err
+			}
+		}
+		return os.Symlink(filepath.FromSlash(c.Entry.Target), c.Full)
+	}
+	if oldLink {
+		// replace the link instead of writing to where it points
+		if err := os.Remove(c.Full); err != nil {
+			return err
+		}
+	}
+	write := c.Kind == changeAdd || oldLink || c.Kind != changePerm && c.OldContent != c.Entry.Content
+	if write {
+		if err := os.WriteFile(c.Full, []byte(c.Entry.Content), c.Perm); err != nil {
+			return err
+		}
+	}
+	// WriteFile doesn't touch the perm of existing files and the umask applies
+	if err := os.Chmod(c.Full, c.Perm); err != nil {
+		return err
+	}
+	return c.restoreTime()
+}
+
+// restoreTime sets the mtime recorded in the entry if PreserveTimes is set,
+// merged files keep their current mtime
+func (c fileChange) restoreTime() error {
+	if !PreserveTimes || c.Entry.MTime == "" || c.Entry.Delete || c.Entry.isSymlink() || c.Skip != "" {
+		return nil
+	}
+	if c.Conflict != "" && OnConflict == ConflictMerge {
+		return nil
+	}
+	mtime, err := parseMTime(c.Entry.MTime)
+	if err != nil {
+		return fmt.Errorf("%s: invalid mtime %q: %w", c.Path, c.Entry.MTime, err)
+	}
+	return os.Chtimes(c.Full, time.Time{}, mtime)
+}
+
+// useColor returns true if diffs written to stdout should be colored
+func useColor() bool {
+	if NoColor || os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	info, err := os.Stdout.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// openTerminal returns where interactive answers are read from, that's stdin
+// unless the tree itself is read from stdin
+func openTerminal(inputPath string) (io.ReadCloser, error) {
+	if inputPath != "-" {
+		return io.NopCloser(os.Stdin), nil
+	}
+	tty := "/dev/tty"
+	if runtime.GOOS == "windows" {
+		tty = "CONIN$"
+	}
+	f, err := os.Open(tty)
+	if err != nil {
+		return nil, fmt.Errorf("--interactive needs a terminal when the input is stdin: %w", err)
+	}
+	return f, nil
+}
+
+// expandTree applies (or with DryRun/Interactive previews) tree below
+// destRoot, inputPath is only needed to know where to ask questions
+func expandTree(tree map[string]Entry, destRoot string, inputPath string, base map[string]Entry) error {
+	changes, err := planExpand(tree, destRoot, base)
+	if err != nil {
+		return err
+	}
+
+	var conflicting []string
+	for _, c := range changes {
+		if c.Skip != "" {
+			fmt.Fprintf(os.Stderr, "skipping: %s %s\n", c.Path, c.Skip)
+		}
+		if c.Conflict != "" {
+			conflicting = append(conflicting, c.Path)
+			fmt.Fprintf(os.Stderr, "conflict: %s %s\n", c.Path, c.Conflict)
+		}
+	}
+
+	color := useColor()
+	if DryRun {
+		pending := 0
+		for _, c := range changes {
+			if c.Kind == changeNone {
+				continue
+			}
+			pending++
+			fmt.Print(c.diff(color))
+		}
+		if pending > 0 {
+			fmt.Fprintf(os.Stderr, "%d of %d files would change\n", pending, len(changes))
+			return ErrChangesPending
+		}
+		return nil
+	}
+
+	if len(conflicting) > 0 && OnConflict == ConflictRefuse {
+		return fmt.Errorf("refusing to expand, %d files changed since they were flattened: %s (see --on-conflict)",
+			len(conflicting), strings.Join(conflicting, ", "))
+	}
+
+	applied, err := applyChanges(applyOrder(changes), inputPath, color)
+	if conflictErr := reportMergeConflicts(applied); err == nil {
+		err = conflictErr
+	}
+	return err
+}
+
+// applyChanges applies changes, asking for each one with Interactive, and
+// returns the ones that were applied
+func applyChanges(changes []fileChange, inputPath string, color bool) ([]fileChange, error) {
+	var applied []fileChange
+	if !Interactive {
+		for _, c := range changes {
+			if err := c.apply(); err != nil {
+				return applied, err
+			}
+			applied = append(applied, c)
+		}
+		return applied, nil
+	}
+
+	tty, err := openTerminal(inputPath)
+	if err != nil {
+		return nil, err
+	}
+	defer tty.Close()
+	answers := bufio.NewReader(tty)
+
+	all := false
+	for _, c := range changes {
+		if c.Kind == changeNone {
+			if err := c.restoreTime(); err != nil {
+				return applied, err
+			}
+			continue
+		}
+		if !all {
+			fmt.Print(c.diff(color))
+			answer, err := askApply(answers, c)
+			if err != nil {
+				return applied, err
+			}
+			switch answer {
+			case "n":
+				continue
+			case "q":
+				return applied, nil
+			case "a":
+				all = true
+			}
+		}
+		if err := c.apply(); err != nil {
+			return applied, err
+		}
+		applied = append(applied, c)
+	}
+	return applied, nil
+}
+
+// reportMergeConflicts lists the files that got conflict markers, it returns
+// ErrMergeConflicts if there are any
+func reportMergeConflicts(changes []fileChange) error {
+	var files []string
+	for _, c := range changes {
+		if c.Conflicts > 0 {
+			fmt.Fprintf(os.Stderr, "merge conflict: %s (%d blocks)\n", c.Path, c.Conflicts)
+			files = append(files, c.Path)
+		}
+	}
+	if len(files) > 0 {
+		return fmt.Errorf("%w: %s", ErrMergeConflicts, strings.Join(files, ", "))
+	}
+	return nil
+}
+
+// askApply asks until it gets one of y/n/a/q
+func askApply(answers *bufio.Reader, c fileChange) (string, error) {
+	for {
+		fmt.Fprintf(os.Stderr, "Apply %s (%s) [y,n,a,q,?]? ", c.Path, c.Kind)
+		line, err := answers.ReadString('\n')
+		if err != nil && line == "" {
+			if err == io.EOF {
+				return "q", nil
+			}
+			return "", err
+		}
+		answer := strings.ToLower(strings.TrimSpace(line))
+		switch answer {
+		case "y", "n", "a", "q":
+			return answer, nil
+		}
+		fmt.Fprintln(os.Stderr, "y - apply this file\nn - skip this file\na - apply this and all remaining files\nq - quit, skip all remaining files")
+	}
+}
@@ -0,0 +1,303 @@
+package filetree
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeTestFiles writes files (path -> content) below dir
+func writeTestFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for p, content := range files {
+		full := filepath.Join(dir, filepath.FromSlash(p))
+		if err := os.MkdirAll(filepath.Dir(full), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(full, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Snapshots have hashes by default, a file that isn't there yet must not be
+// taken for one that was deleted since
+func TestExpandSnapshotIntoEmptyDir(t *testing.T) {
+	files := map[string]string{
+		"a.txt":       "hello\n",
+		"sub/b.go":    "package sub\n",
+		"sub/c/d.txt": "no newline",
+	}
+	src := t.TempDir()
+	writeTestFiles(t, src, files)
+
+	for _, format := range []string{FormatYAML, FormatJSON, FormatJSONL, FormatMD, FormatTar, FormatTarGz, FormatZip} {
+		t.Run(format, func(t *testing.T) {
+			defer keep(&OutputFormat)()
+			OutputFormat = format
+			snapshot := filepath.Join(t.TempDir(), "snapshot")
+			if err := DirTreeToYAML(src, snapshot, []string{}, false); err != nil {
+				t.Fatal(err)
+			}
+
+			dest := t.TempDir()
+			if err := YAMLToDirTree(snapshot, dest); err != nil {
+				t.Fatal(err)
+			}
+			for p, want := range files {
+				got, err := os.ReadFile(filepath.Join(dest, filepath.FromSlash(p)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(got) != want {
+					t.Errorf("%s: got %q, want %q", p, got, want)
+				}
+			}
+		})
+	}
+}
+
+// expandYAML expands the YAML tree below dest
+func expandYAML(t *testing.T, tree string, dest string) error {
+	t.Helper()
+	defer keep(&InputFormat)()
+	InputFormat = FormatYAML
+	snapshot := filepath.Join(t.TempDir(), "tree.yaml")
+	writeTestFiles(t, filepath.Dir(snapshot), map[string]string{"tree.yaml": tree})
+	return YAMLToDirTree(snapshot, dest)
+}
+
+// Symlinks the tree creates itself must not lead out of the output root
+func TestExpandThroughTreeSymlinks(t *testing.T) {
+	for name, tree := range map[string]string{
+		"chained": "d/x:\n  type: symlink\n  target: ..\nd/x/y:\n  type: symlink\n  target: ..\nd/x/y/pwned.txt:\n  content: pwned\n",
+		"single":  "l:\n  type: symlink\n  target: sub\nl/pwned.txt:\n  content: pwned\n",
+		"rename":  "l:\n  type: symlink\n  target: sub\nl/pwned.txt:\n  renamed_from: a.txt\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			outside := t.TempDir()
+			dest := filepath.Join(outside, "a", "root")
+			writeTestFiles(t, dest, map[string]string{"a.txt": "a\n", "sub/keep": ""})
+			if err := expandYAML(t, tree, dest); err == nil {
+				t.Error("expand succeeded")
+			}
+			filepath.WalkDir(outside, func(p string, d os.DirEntry, err error) error {
+				if err == nil && d.Name() == "pwned.txt" {
+					t.Errorf("expand wrote %s", p)
+				}
+				return nil
+			})
+		})
+	}
+}
+
+// A parent that was replaced by a symlink after planning is caught when the
+// change is applied
+func TestExpandRechecksParents(t *testing.T) {
+	dest := t.TempDir()
+	outside := t.TempDir()
+	writeTestFiles(t, dest, map[string]string{"d/a.txt": "a\n"})
+	changes, err := planExpand(map[string]Entry{"d/a.txt": {Content: "b\n"}}, dest, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(filepath.Join(dest, "d")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(dest, "d")); err != nil {
+		t.Fatal(err)
+	}
+	if err := changes[0].apply(); err == nil {
+		t.Error("apply wrote through a symlink")
+	}
+	if _, err := os.Stat(filepath.Join(outside, "a.txt")); !os.IsNotExist(err) {
+		t.Error("apply wrote outside of the output root")
+	}
+}
+
+// Links are created after everything else, a file is never written through
+// one the same expand created
+func TestExpandCreatesSymlinksLast(t *testing.T) {
+	dest := t.TempDir()
+	writeTestFiles(t, dest, map[string]string{"old": "old\n"})
+	tree := map[string]Entry{
+		"a":       {Type: EntryTypeSymlink, Target: "z"},
+		"b/c":     {Type: EntryTypeSymlink, Target: "../z/d"},
+		"b/d.txt": {Content: "d\n"},
+		"old":     {Type: EntryTypeSymlink, Target: "z"},
+		"z/d":     {Content: "d\n"},
+		"z/e.txt": {Content: "e\n"},
+	}
+	changes, err := planExpand(tree, dest, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	links := false
+	for _, c := range applyOrder(changes) {
+		if c.Entry.isSymlink() {
+			links = true
+		} else if links {
+			t.Errorf("%s is applied after a symlink", c.Path)
+		}
+		if err := c.apply(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if target, err := os.Readlink(filepath.Join(dest, "old")); err != nil || target != "z" {
+		t.Errorf("old: got %q, %v", target, err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dest, "b", "c")); err != nil || string(data) != "d\n" {
+		t.Errorf("b/c: got %q, %v", data, err)
+	}
+}
+
+// readTestFiles returns the regular files below dir (path -> content)
+func readTestFiles(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files := map[string]string{}
+	err := filepath.WalkDir(dir, func(p string, d os.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, p)
+		files[filepath.ToSlash(rel)] = string(data)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestExpandRenames(t *testing.T) {
+	files := map[string]string{"a": "a\n", "c": "c\n", "x": "x\n"}
+	for _, c := range []struct {
+		name string
+		tree string
+		want map[string]string // nil if expand has to fail
+	}{
+		{"rename", "z:\n  renamed_from: a\n", map[string]string{"z": "a\n", "c": "c\n", "x": "x\n"}},
+		{"rename and edit", "z:\n  renamed_from: a\n  content: new\n", map[string]string{"z": "new", "c": "c\n", "x": "x\n"}},
+		{"rename into a dir", "d/z:\n  renamed_from: a\nx:\n  delete: true\n", map[string]string{"d/z": "a\n", "c": "c\n"}},
+		{"swap-like chain", "b:\n  renamed_from: a\nd:\n  renamed_from: c\n", map[string]string{"b": "a\n", "d": "c\n", "x": "x\n"}},
+		{"source written", "a:\n  content: new\nz:\n  renamed_from: a\n", nil},
+		{"source deleted", "a:\n  delete: true\nz:\n  renamed_from: a\n", nil},
+		{"source renamed twice", "b:\n  renamed_from: a\nd:\n  renamed_from: a\ne:\n  renamed_from: c\n", nil},
+		{"chain", "b:\n  renamed_from: a\nd:\n  renamed_from: b\n", nil},
+		{"onto itself", "a:\n  renamed_from: a\n", nil},
+		{"over an existing file", "c:\n  renamed_from: a\n", nil},
+		{"missing source", "z:\n  renamed_from: nope\n", nil},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			dest := t.TempDir()
+			writeTestFiles(t, dest, files)
+			err := expandYAML(t, c.tree, dest)
+			want := c.want
+			if want == nil {
+				if err == nil {
+					t.Error("expand succeeded")
+				}
+				want = files // nothing is touched
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if got := readTestFiles(t, dest); !reflect.DeepEqual(got, want) {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+// Replies without hashes (Markdown has none) are checked against --base
+func TestExpandConflictWithoutHash(t *testing.T) {
+	for _, c := range []struct {
+		name, onConflict, reply, want string
+		err                           error // nil, ErrMergeConflicts or errAny
+	}{
+		{"refuse", ConflictRefuse, "one\ntwo\nTHREE\n", "ONE\ntwo\nthree\n", errAny},
+		{"merge", ConflictMerge, "one\ntwo\nTHREE\n", "ONE\ntwo\nTHREE\n", nil},
+		{"merge conflict", ConflictMerge, "one!\ntwo\nthree\n", "", ErrMergeConflicts},
+		{"overwrite", ConflictOverwrite, "one\ntwo\nTHREE\n", "one\ntwo\nTHREE\n", nil},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			defer keep(&OnConflict)()
+			defer keep(&BasePath)()
+			defer keep(&InputFormat)()
+			OnConflict = c.onConflict
+
+			dest := t.TempDir()
+			writeTestFiles(t, dest, map[string]string{"a.txt": "one\ntwo\nthree\n"})
+			BasePath = filepath.Join(t.TempDir(), "base.yaml")
+			if err := DirTreeToYAML(dest, BasePath, []string{}, false); err != nil {
+				t.Fatal(err)
+			}
+			writeTestFiles(t, dest, map[string]string{"a.txt": "ONE\ntwo\nthree\n"}) // a local edit
+
+			reply := filepath.Join(t.TempDir(), "reply.md")
+			writeTestFiles(t, filepath.Dir(reply), map[string]string{"reply.md": "### a.txt\n\n```\n" + c.reply + "```\n"})
+			InputFormat = FormatMD
+			err := YAMLToDirTree(reply, dest)
+			switch {
+			case c.err == errAny && err == nil, c.err == nil && err != nil, c.err != errAny && c.err != nil && !errors.Is(err, c.err):
+				t.Fatalf("got error %v, want %v", err, c.err)
+			}
+			got, _ := os.ReadFile(filepath.Join(dest, "a.txt"))
+			if c.want == "" {
+				if !strings.Contains(string(got), "<<<<<<<") {
+					t.Errorf("no conflict markers in %q", got)
+				}
+			} else if string(got) != c.want {
+				t.Errorf("got %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+// errAny stands for any error in the test tables
+var errAny = errors.New("any error")
+
+// A reply that drops "truncated: true" of a cut short file still has its hash,
+// the truncation line must keep it from being written over the real file
+func TestExpandDroppedTruncatedFlag(t *testing.T) {
+	defer keep(&MaxFileSize)()
+	defer keep(&FileSizePolicy)()
+	defer keep(&OutputFormat)()
+	MaxFileSize, FileSizePolicy, OutputFormat = 40, SizePolicyTruncateMiddle, FormatYAML
+
+	big := strings.Repeat("a line of the big file\n", 10)
+	quoted := "about\n... [12 bytes truncated] ...\n" // below --max-file-size
+	dest := t.TempDir()
+	writeTestFiles(t, dest, map[string]string{"big.txt": big, "quoted.txt": quoted})
+	snapshot := filepath.Join(t.TempDir(), "tree.yaml")
+	if err := DirTreeToYAML(dest, snapshot, []string{}, false); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "truncated: true") {
+		t.Fatalf("big.txt isn't truncated in %s", b)
+	}
+	reply := strings.ReplaceAll(string(b), "truncated: true", "")
+	reply = strings.Replace(reply, "about", "About", 1) // files may quote the line
+
+	MaxFileSize = 0
+	if err := expandYAML(t, reply, dest); err != nil {
+		t.Fatal(err)
+	}
+	got := readTestFiles(t, dest)
+	if got["big.txt"] != big {
+		t.Errorf("big.txt was overwritten with %q", got["big.txt"])
+	}
+	if want := "A" + quoted[1:]; got["quoted.txt"] != want {
+		t.Errorf("quoted.txt: got %q, want %q", got["quoted.txt"], want)
+	}
+}
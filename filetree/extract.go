@@ -0,0 +1,339 @@
+package filetree
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// entryFields are the keys an entry can have, they tell a tree from any other
+// YAML or JSON in a reply
+var entryFields = map[string]bool{
+	"type":         true,
+	"target":       true,
+	"perm":         true,
+	"hash":         true,
+	"size":         true,
+	"mtime":        true,
+	"encoding":     true,
+	"content":      true,
+	"truncated":    true,
+	"delete":       true,
+	"renamed_from": true,
+}
+
+// isTreeNode returns true if node is a non-empty mapping of paths to entries
+func isTreeNode(node *yaml.Node) bool {
+	if node.Kind == yaml.DocumentNode {
+		if len(node.Content) == 0 {
+			return false
+		}
+		node = node.Content[0]
+	}
+	if node.Kind != yaml.MappingNode || len(node.Content) == 0 {
+		return false
+	}
+	for i := 1; i < len(node.Content); i += 2 {
+		v := node.Content[i]
+		if v.Kind != yaml.MappingNode {
+			return false
+		}
+		for j := 0; j < len(v.Content); j += 2 {
+			if !entryFields[v.Content[j].Value] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// codeBlock is a fenced block of a reply
+type codeBlock struct {
+	Lang    string
+	Content string
+	Closed  bool // false if the reply ends inside of it
+}
+
+// codeBlocks returns the fenced blocks of text, fences have to start at the
+// beginning of a line so the ones in indented YAML content don't count
+func codeBlocks(text string) []codeBlock {
+	lines := strings.Split(text, "\n")
+	var blocks []codeBlock
+	for i := 0; i < len(lines); i++ {
+		fm := reMarkdownFence.FindStringSubmatch(lines[i])
+		if fm == nil {
+			continue
+		}
+		block := codeBlock{Lang: strings.ToLower(fm[2])}
+		var content strings.Builder
+		for i++; i < len(lines); i++ {
+			if isClosingFence(lines[i], fm[1]) {
+				block.Closed = true
+				break
+			}
+			content.WriteString(lines[i])
+			content.WriteString("\n")
+		}
+		block.Content = content.String()
+		blocks = append(blocks, block)
+	}
+	return blocks
+}
+
+// isYAMLKeyLine returns true for the lines that start an entry of a flattened
+// YAML tree
+func isYAMLKeyLine(line string) bool {
+	line = strings.TrimRight(line, " \t\r\n")
+	if line == "" || strings.ContainsRune(" \t#-", rune(line[0])) || line == "..." {
+		return false
+	}
+	return strings.HasSuffix(line, ":")
+}
+
+// yamlKey returns the path of a key line
+func yamlKey(line string) string {
+	m := map[string]any{}
+	if err := yaml.Unmarshal([]byte(line), &m); err == nil {
+		for k := range m {
+			return k
+		}
+	}
+	return strings.TrimSuffix(strings.TrimSpace(line), ":")
+}
+
+// decodeYAMLBlock decodes a YAML tree that may be cut off. Entries are dropped
+// from the end until the rest parses, they are returned as cut. If the block
+// isn't closed its last entry is cut too, a block scalar parses fine when it
+// ends early.
+func decodeYAMLBlock(content string, closed bool) (map[string]Entry, []string, bool) {
+	lines := strings.SplitAfter(content, "\n")
+	var starts []int
+	for i, line := range lines {
+		if isYAMLKeyLine(line) {
+			starts = append(starts, i)
+		}
+	}
+
+	var cut []string
+	n, end := len(starts), len(lines) // entries left, where they end
+	for {
+		tree, ok := parseYAMLTree(strings.Join(lines[:end], ""))
+		if ok {
+			if !closed && n == len(starts) && n > 0 {
+				last := yamlKey(lines[starts[n-1]])
+				delete(tree, last)
+				cut = append(cut, last)
+			}
+			return tree, cut, true
+		}
+		if n <= 1 {
+			return nil, nil, false
+		}
+		n--
+		end = starts[n]
+		cut = append(cut, yamlKey(lines[end]))
+	}
+}
+
+// parseYAMLTree decodes data if it's a YAML tree
+func parseYAMLTree(data string) (map[string]Entry, bool) {
+	var node yaml.Node
+	if err := yaml.Unmarshal([]byte(data), &node); err != nil || !isTreeNode(&node) {
+		return nil, false
+	}
+	tree := map[string]Entry{}
+	if err := node.Decode(&tree); err != nil {
+		return nil, false
+	}
+	return tree, true
+}
+
+// decodeJSONBlock decodes a JSON tree that may be cut off, the entries after
+// the first one that doesn't parse are lost and it's returned as cut
+func decodeJSONBlock(content string) (map[string]Entry, []string, bool) {
+	dec := json.NewDecoder(strings.NewReader(content))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, nil, false
+	}
+	tree := map[string]Entry{}
+	var cut []string
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			break
+		}
+		key, _ := tok.(string)
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			cut = append(cut, key)
+			break
+		}
+		var node yaml.Node
+		if err := yaml.Unmarshal([]byte(fmt.Sprintf("{%q: %s}", key, raw)), &node); err != nil || !isTreeNode(&node) {
+			return nil, nil, false
+		}
+		var entry Entry
+		if err := json.Unmarshal(raw, &entry); err != nil {
+			return nil, nil, false
+		}
+		tree[key] = entry
+	}
+	if len(tree) == 0 {
+		return nil, nil, false
+	}
+	return tree, cut, true
+}
+
+// decodeBlock decodes a YAML or JSON tree, ok is false if it isn't one
+func decodeBlock(content string, closed bool) (map[string]Entry, []string, bool) {
+	if strings.HasPrefix(strings.TrimSpace(content), "{") {
+		return decodeJSONBlock(content)
+	}
+	return decodeYAMLBlock(content, closed)
+}
+
+// unfencedYAML returns the part of text that looks like a YAML tree, from the
+// first path followed by an indented entry field to the first line of prose
+func unfencedYAML(text string) (string, bool) {
+	lines := strings.SplitAfter(text, "\n")
+	isEntryStart := func(i int) bool {
+		if !isYAMLKeyLine(lines[i]) {
+			return false
+		}
+		j := i + 1
+		for j < len(lines) && strings.TrimSpace(lines[j]) == "" {
+			j++
+		}
+		if j == len(lines) || (lines[j][0] != ' ' && lines[j][0] != '\t') {
+			return false
+		}
+		field, _, _ := strings.Cut(strings.TrimSpace(lines[j]), ":")
+		return entryFields[field]
+	}
+
+	start := -1
+	for i := range lines {
+		if isEntryStart(i) {
+			start = i
+			break
+		}
+	}
+	if start < 0 {
+		return "", false
+	}
+	end := start + 1
+	for ; end < len(lines); end++ {
+		line := lines[end]
+		if strings.TrimSpace(line) == "" || line[0] == ' ' || line[0] == '\t' || line[0] == '#' {
+			continue
+		}
+		if !isEntryStart(end) {
+			break
+		}
+	}
+	closed := end < len(lines) || strings.HasSuffix(text, "\n")
+	return strings.Join(lines[start:end], ""), closed
+}
+
+// extractTree finds the tree in data, which may be a whole model reply: prose
+// around it, one or more fenced YAML/JSON blocks (merged, later ones win) or a
+// Markdown tree. Entries that are cut off (a reply that ended early) are left
+// out of the tree and returned separately.
+func extractTree(data []byte) (map[string]Entry, []string, error) {
+	format := detectFormat(data)
+	if isArchiveFormat(format) {
+		tree, err := decodeTree(data, format)
+		return tree, nil, err
+	}
+	if format == FormatJSONL {
+		tree, err := decodeTree(data, format)
+		if err != nil {
+			// a JSON tree that was cut off doesn't parse as one
+			if tree, cut, ok := decodeJSONBlock(string(data)); ok {
+				return tree, cut, nil
+			}
+		}
+		return tree, nil, err
+	}
+
+	// the plain formats as written by flatten, which end with a newline
+	trimmed := bytes.TrimRight(data, " \t\r")
+	if format == FormatJSON || format == FormatYAML && (len(trimmed) == 0 || bytes.HasSuffix(trimmed, []byte("\n"))) {
+		var node yaml.Node
+		if err := yaml.Unmarshal(data, &node); err == nil && (isTreeNode(&node) || len(bytes.TrimSpace(data)) == 0 || string(bytes.TrimSpace(data)) == "{}") {
+			tree, err := decodeTree(data, format)
+			return tree, nil, err
+		}
+	}
+
+	text := strings.ReplaceAll(string(data), "\r\n", "\n")
+	tree := map[string]Entry{}
+	cut := map[string]bool{}
+	found := false
+	for _, block := range codeBlocks(text) {
+		switch block.Lang {
+		case "", "yaml", "yml", "json":
+		default:
+			continue
+		}
+		blockTree, blockCut, ok := decodeBlock(block.Content, block.Closed)
+		if !ok {
+			continue
+		}
+		found = true
+		for p, entry := range blockTree {
+			tree[p] = entry
+			delete(cut, p)
+		}
+		for _, p := range blockCut {
+			delete(tree, p)
+			cut[p] = true
+		}
+	}
+
+	if !found && looksLikeMarkdownTree(data) {
+		mdTree, p, err := decodeMarkdownPartial([]byte(text))
+		if err != nil {
+			return nil, nil, err
+		}
+		tree, found = mdTree, true
+		if p != "" {
+			cut[p] = true
+		}
+	}
+
+	if !found && format == FormatJSON {
+		var blockCut []string
+		tree, blockCut, found = decodeJSONBlock(text)
+		for _, p := range blockCut {
+			cut[p] = true
+		}
+	}
+
+	if !found {
+		if content, closed := unfencedYAML(text); content != "" {
+			var blockCut []string
+			tree, blockCut, found = decodeYAMLBlock(content, closed)
+			for _, p := range blockCut {
+				cut[p] = true
+			}
+		}
+	}
+
+	if !found {
+		// not a tree, let the decoder say why
+		tree, err := decodeTree(data, format)
+		return tree, nil, err
+	}
+
+	var cutPaths []string
+	for p := range cut {
+		cutPaths = append(cutPaths, p)
+	}
+	sort.Strings(cutPaths)
+	return tree, cutPaths, nil
+}
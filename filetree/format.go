@@ -0,0 +1,274 @@
+package filetree
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/mrvnmyr/oat/common"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	FormatYAML  = "yaml"
+	FormatJSON  = "json"
+	FormatJSONL = "jsonl"
+	FormatMD    = "md"
+	FormatTar   = "tar"
+	FormatTarGz = "tar.gz"
+	FormatZip   = "zip"
+)
+
+var (
+	// OutputFormat is the format flatten writes
+	OutputFormat string = FormatYAML
+
+	// InputFormat is the format expand reads, "" means detect it from the data
+	InputFormat string = ""
+)
+
+// isArchiveFormat returns true for the binary archive formats
+func isArchiveFormat(format string) bool {
+	switch format {
+	case FormatTar, FormatTarGz, FormatZip:
+		return true
+	}
+	return false
+}
+
+// sortedPaths returns the keys of tree in lexical order
+func sortedPaths(tree map[string]Entry) []string {
+	paths := make([]string, 0, len(tree))
+	for p := range tree {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// treeWriter encodes a tree entry by entry, the entries have to come in
+// sorted path order
+type treeWriter interface {
+	Write(p string, entry Entry) error
+	Close() error // finishes the output, the underlying writer stays open
+}
+
+// newTreeWriter returns a treeWriter that writes the given format to w
+func newTreeWriter(w io.Writer, format string) (treeWriter, error) {
+	switch format {
+	case FormatYAML, "":
+		return &yamlTreeWriter{w: w}, nil
+	case FormatJSON:
+		return &jsonTreeWriter{w: w}, nil
+	case FormatJSONL:
+		return &jsonlTreeWriter{enc: newJSONEncoder(w)}, nil
+	case FormatMD:
+		return &markdownTreeWriter{w: w}, nil
+	case FormatTar:
+		return newTarTreeWriter(w, false), nil
+	case FormatTarGz:
+		return newTarTreeWriter(w, true), nil
+	case FormatZip:
+		return newZipTreeWriter(w), nil
+	}
+	return nil, fmt.Errorf("unknown format: %s", format)
+}
+
+// encodeTree serializes tree in the given format
+func encodeTree(tree map[string]Entry, format string) ([]byte, error) {
+	var buf bytes.Buffer
+	tw, err := newTreeWriter(&buf, format)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range sortedPaths(tree) {
+		if err := tw.Write(p, tree[p]); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// yamlTreeWriter writes a YAML mapping one key at a time
+type yamlTreeWriter struct {
+	w     io.Writer
+	count int
+}
+
+func (tw *yamlTreeWriter) Write(p string, entry Entry) error {
+	out, err := yaml.Marshal(map[string]Entry{p: entry})
+	if err != nil {
+		return err
+	}
+	tw.count++
+	_, err = tw.w.Write(out)
+	return err
+}
+
+func (tw *yamlTreeWriter) Close() error {
+	if tw.count == 0 {
+		_, err := io.WriteString(tw.w, "{}\n")
+		return err
+	}
+	return nil
+}
+
+// newJSONEncoder returns an encoder that leaves <, > and & alone, escaping
+// them only bloats the content of source files
+func newJSONEncoder(w io.Writer) *json.Encoder {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return enc
+}
+
+// marshalJSON is json.MarshalIndent without escaping HTML
+func marshalJSON(v any, prefix, indent string) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := newJSONEncoder(&buf)
+	enc.SetIndent(prefix, indent)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// jsonTreeWriter writes the same object json.MarshalIndent does for the
+// whole tree
+type jsonTreeWriter struct {
+	w     io.Writer
+	count int
+}
+
+func (tw *jsonTreeWriter) Write(p string, entry Entry) error {
+	key, err := marshalJSON(p, "", "")
+	if err != nil {
+		return err
+	}
+	value, err := marshalJSON(entry, "  ", "  ")
+	if err != nil {
+		return err
+	}
+	sep := ",\n  "
+	if tw.count == 0 {
+		sep = "{\n  "
+	}
+	tw.count++
+	_, err = fmt.Fprintf(tw.w, "%s%s: %s", sep, key, value)
+	return err
+}
+
+func (tw *jsonTreeWriter) Close() error {
+	end := "\n}\n"
+	if tw.count == 0 {
+		end = "{}\n"
+	}
+	_, err := io.WriteString(tw.w, end)
+	return err
+}
+
+// decodeTree parses data in the given format, or detects the format if it is ""
+func decodeTree(data []byte, format string) (map[string]Entry, error) {
+	if format == "" {
+		format = detectFormat(data)
+	}
+	common.Debugf("Input format: %s\n", format)
+
+	switch format {
+	case FormatYAML:
+		tree := map[string]Entry{}
+		if err := yaml.Unmarshal(data, &tree); err != nil {
+			return nil, err
+		}
+		return tree, nil
+	case FormatJSON:
+		tree := map[string]Entry{}
+		if err := json.Unmarshal(data, &tree); err != nil {
+			return nil, err
+		}
+		return tree, nil
+	case FormatJSONL:
+		return decodeJSONL(bytes.NewReader(data))
+	case FormatMD:
+		return decodeMarkdown(data)
+	case FormatTar:
+		return decodeTar(bytes.NewReader(data), false)
+	case FormatTarGz:
+		return decodeTar(bytes.NewReader(data), true)
+	case FormatZip:
+		return decodeZip(data)
+	}
+	return nil, fmt.Errorf("unknown format: %s", format)
+}
+
+// detectFormat guesses the format of data by looking at its magic bytes
+func detectFormat(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte{0x1f, 0x8b}):
+		return FormatTarGz
+	case bytes.HasPrefix(data, []byte("PK\x03\x04")), bytes.HasPrefix(data, []byte("PK\x05\x06")):
+		return FormatZip
+	case len(data) >= 262 && bytes.Equal(data[257:262], []byte("ustar")):
+		return FormatTar
+	}
+
+	if trimmed := bytes.TrimSpace(data); bytes.HasPrefix(trimmed, []byte("{")) {
+		// a single JSON object is either a whole tree or a one-line JSONL file
+		var obj map[string]json.RawMessage
+		if err := json.Unmarshal(trimmed, &obj); err != nil {
+			return FormatJSONL
+		}
+		if p, ok := obj["path"]; ok && bytes.HasPrefix(p, []byte(`"`)) {
+			return FormatJSONL
+		}
+		return FormatJSON
+	}
+	if looksLikeMarkdownTree(data) {
+		return FormatMD
+	}
+	return FormatYAML
+}
+
+// jsonlEntry is one line of the JSONL format
+type jsonlEntry struct {
+	Path string `json:"path"`
+	Entry
+}
+
+// jsonlTreeWriter writes one {path, perm, content} object per line
+type jsonlTreeWriter struct {
+	enc *json.Encoder
+}
+
+func (tw *jsonlTreeWriter) Write(p string, entry Entry) error {
+	return tw.enc.Encode(jsonlEntry{Path: p, Entry: entry})
+}
+
+func (tw *jsonlTreeWriter) Close() error {
+	return nil
+}
+
+// decodeJSONL reads {path, perm, content} objects until EOF
+func decodeJSONL(r io.Reader) (map[string]Entry, error) {
+	tree := map[string]Entry{}
+	dec := json.NewDecoder(r)
+	for line := 1; ; line++ {
+		var je jsonlEntry
+		err := dec.Decode(&je)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("jsonl entry %d: %w", line, err)
+		}
+		if je.Path == "" {
+			return nil, fmt.Errorf("jsonl entry %d: missing path", line)
+		}
+		tree[je.Path] = je.Entry
+	}
+	return tree, nil
+}
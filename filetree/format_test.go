@@ -0,0 +1,31 @@
+package filetree
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// JSON keeps <, > and & as they are, escaped they bloat the output
+func TestJSONFormatsKeepHTML(t *testing.T) {
+	tree := map[string]Entry{
+		"a<b>.html": {Content: "<p>a && b</p>\n"},
+		"b.go":      {Content: "if a < b && c > d {}\n"},
+	}
+	for _, format := range []string{FormatJSON, FormatJSONL} {
+		data, err := encodeTree(tree, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(data), `\u00`) || !strings.Contains(string(data), "<p>a && b</p>") {
+			t.Errorf("%s: HTML was escaped:\n%s", format, data)
+		}
+		got, err := decodeTree(data, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tree) {
+			t.Errorf("%s: round trip changed the tree: %v", format, got)
+		}
+	}
+}
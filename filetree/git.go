@@ -0,0 +1,115 @@
+package filetree
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/mrvnmyr/oat/common"
+)
+
+var (
+	// GitTracked selects the files tracked by git
+	GitTracked bool = false
+
+	// GitChanged selects the files changed since this ref (including untracked ones)
+	GitChanged string = ""
+
+	// GitStaged selects the files in the git index that differ from HEAD
+	GitStaged bool = false
+)
+
+// runGit runs git in dir and returns its stdout
+func runGit(dir string, args ...string) ([]byte, error) {
+	args = append([]string{"-C", dir}, args...)
+	common.Debugf("Running: git %s\n", strings.Join(args, " "))
+
+	cmd := exec.Command("git", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// verifyRev returns an error unless rev names an object git can peel with
+// peel (e.g. "^{commit}", "" for any object). Revisions are user input, one
+// starting with "-" would otherwise be taken for an option.
+func verifyRev(dir string, rev string, peel string) error {
+	if rev == "" || strings.HasPrefix(rev, "-") {
+		return fmt.Errorf("invalid git revision %q", rev)
+	}
+	if _, err := runGit(dir, "rev-parse", "--verify", "--quiet", "--end-of-options", rev+peel); err != nil {
+		return fmt.Errorf("%s is not a git revision: %w", rev, err)
+	}
+	return nil
+}
+
+// splitNul splits the -z output of git
+func splitNul(out []byte) []string {
+	var paths []string
+	for _, p := range strings.Split(string(out), "\x00") {
+		if p != "" {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// wantsGitSelection returns true if any --git-* flag is set
+func wantsGitSelection() bool {
+	return GitTracked || GitChanged != "" || GitStaged
+}
+
+// gitSelection returns the paths (relative to dir) selected by the --git-*
+// flags, or nil if none of them is set
+func gitSelection(dir string) (map[string]bool, error) {
+	if !wantsGitSelection() {
+		return nil, nil
+	}
+
+	var queries [][]string
+	if GitTracked {
+		queries = append(queries, []string{"ls-files", "-z"})
+	}
+	if GitChanged != "" {
+		if err := verifyRev(dir, GitChanged, "^{commit}"); err != nil {
+			return nil, err
+		}
+		queries = append(queries,
+			[]string{"diff", "--name-only", "-z", "--relative", "--diff-filter=d", "--end-of-options", GitChanged, "--"},
+			[]string{"ls-files", "-z", "--others", "--exclude-standard"},
+		)
+	}
+	if GitStaged {
+		queries = append(queries, []string{"diff", "--name-only", "-z", "--relative", "--diff-filter=d", "--cached", "--"})
+	}
+
+	selection := map[string]bool{}
+	for _, args := range queries {
+		out, err := runGit(dir, args...)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range splitNul(out) {
+			selection[p] = true
+		}
+	}
+	common.Debugf("Git selected %d files\n", len(selection))
+	return selection, nil
+}
+
+// isSelected replaces shouldAllow if there's a git selection: a file has to
+// be selected or explicitly allowed by AllowedGlobs (the context files)
+func isSelected(relPath string, selection map[string]bool) bool {
+	if selection == nil {
+		return shouldAllow(relPath, false)
+	}
+	if selection[relPath] {
+		return true
+	}
+	return len(AllowedGlobs) > 0 && shouldAllow(relPath, false)
+}
@@ -0,0 +1,424 @@
+package filetree
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/mrvnmyr/oat/common"
+)
+
+// ignoreRule is a single compiled pattern with gitignore semantics
+type ignoreRule struct {
+	Pattern string // as written, without the leading "!"
+	Base    string // directory the pattern is relative to, "" for the root
+	Negate  bool   // "!pattern" re-includes what an earlier rule matched
+	DirOnly bool   // "pattern/" only matches directories
+	Source  string // file the pattern was read from, "" for flags
+	Line    int    // line in Source
+
+	rx *regexp.Regexp
+}
+
+// globOrigins maps the patterns read from .flattenignore/.flattenallow (and
+// the files they include) to the file and line they come from
+var globOrigins = map[string]string{}
+
+// describe names the rule and where it comes from
+func (r *ignoreRule) describe() string {
+	pattern := r.Pattern
+	if r.Negate {
+		pattern = "!" + pattern
+	}
+	switch {
+	case r.Source != "" && r.Line > 0:
+		return fmt.Sprintf("%q (%s:%d)", pattern, r.Source, r.Line)
+	case r.Source != "":
+		return fmt.Sprintf("%q (%s)", pattern, r.Source)
+	}
+	if origin, ok := globOrigins[pattern]; ok {
+		return fmt.Sprintf("%q (%s)", pattern, origin)
+	}
+	return fmt.Sprintf("%q (flag)", pattern)
+}
+
+// ignoreMatcher matches paths against a list of rules, the last matching rule
+// wins like in a .gitignore
+type ignoreMatcher struct {
+	rules []*ignoreRule
+}
+
+// newIgnoreMatcher compiles patterns that are relative to the root
+func newIgnoreMatcher(patterns []string) *ignoreMatcher {
+	m := &ignoreMatcher{}
+	for i, pattern := range patterns {
+		m.add(pattern, "", "", i+1)
+	}
+	return m
+}
+
+// add compiles a single line of a .gitignore like file, blank lines and
+// comments are skipped
+func (m *ignoreMatcher) add(line string, base string, source string, lineNo int) {
+	rule := parseIgnoreRule(line)
+	if rule == nil {
+		return
+	}
+	rule.Base = strings.Trim(base, "/")
+	rule.Source = source
+	rule.Line = lineNo
+	m.rules = append(m.rules, rule)
+}
+
+// parseIgnoreRule compiles one line, returns nil for blank lines and comments
+func parseIgnoreRule(line string) *ignoreRule {
+	line = strings.TrimLeft(line, " \t")
+	line = trimUnescapedTrailingSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil
+	}
+
+	rule := &ignoreRule{}
+	if strings.HasPrefix(line, "!") {
+		rule.Negate = true
+		line = line[1:]
+	}
+	rule.Pattern = line
+
+	line = strings.TrimPrefix(line, "./")
+	if strings.HasSuffix(line, "/") {
+		rule.DirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return nil
+	}
+
+	// a slash anywhere but at the end anchors the pattern to its base
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+
+	rx := "^"
+	if !anchored {
+		rx += "(?:.*/)?"
+	}
+	rx += ignoreGlobToRegexp(line) + "$"
+	rule.rx = regexp.MustCompile(rx)
+	return rule
+}
+
+// trimUnescapedTrailingSpace removes trailing spaces unless they are escaped
+// with a backslash
+func trimUnescapedTrailingSpace(line string) string {
+	for strings.HasSuffix(line, " ") || strings.HasSuffix(line, "\t") {
+		if strings.HasSuffix(line, "\\ ") {
+			break
+		}
+		line = line[:len(line)-1]
+	}
+	return line
+}
+
+// ignoreGlobToRegexp translates a gitignore glob into a regular expression:
+// "*" and "?" don't match "/", "**/" matches any number of directories,
+// "/**" matches everything inside and "[...]" are character classes
+func ignoreGlobToRegexp(glob string) string {
+	var rx strings.Builder
+	for i := 0; i < len(glob); {
+		switch {
+		case strings.HasPrefix(glob[i:], "**/") && (i == 0 || glob[i-1] == '/'):
+			rx.WriteString("(?:.*/)?")
+			i += 3
+		case glob[i:] == "**" && i > 0 && glob[i-1] == '/':
+			rx.WriteString(".*")
+			i += 2
+		case glob[i] == '*':
+			for i < len(glob) && glob[i] == '*' {
+				i++ // other consecutive asterisks are regular ones
+			}
+			rx.WriteString("[^/]*")
+		case glob[i] == '?':
+			rx.WriteString("[^/]")
+			i++
+		case glob[i] == '[':
+			class, n := ignoreCharClass(glob[i:])
+			if n == 0 {
+				rx.WriteString(regexp.QuoteMeta("["))
+				i++
+			} else {
+				rx.WriteString(class)
+				i += n
+			}
+		case glob[i] == '\\' && i+1 < len(glob):
+			rx.WriteString(regexp.QuoteMeta(glob[i+1 : i+2]))
+			i += 2
+		default:
+			rx.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+			i++
+		}
+	}
+	return rx.String()
+}
+
+// posixClasses are the "[:name:]" classes of wildmatch, in the C locale
+var posixClasses = map[string][][2]rune{
+	"alnum":  {{'0', '9'}, {'A', 'Z'}, {'a', 'z'}},
+	"alpha":  {{'A', 'Z'}, {'a', 'z'}},
+	"blank":  {{' ', ' '}, {'\t', '\t'}},
+	"cntrl":  {{0, 31}, {127, 127}},
+	"digit":  {{'0', '9'}},
+	"graph":  {{'!', '~'}},
+	"lower":  {{'a', 'z'}},
+	"print":  {{' ', '~'}},
+	"punct":  {{'!', '/'}, {':', '@'}, {'[', '`'}, {'{', '~'}},
+	"space":  {{'\t', '\r'}, {' ', ' '}},
+	"upper":  {{'A', 'Z'}},
+	"xdigit": {{'0', '9'}, {'A', 'F'}, {'a', 'f'}},
+}
+
+// classRune returns the (backslash escaped) character at the start of s and
+// its length in bytes
+func classRune(s string) (rune, int) {
+	if len(s) > 1 && s[0] == '\\' {
+		r, n := utf8.DecodeRuneInString(s[1:])
+		return r, n + 1
+	}
+	return utf8.DecodeRuneInString(s)
+}
+
+// ignoreCharClass translates a "[...]" class at the start of glob, returns
+// the regexp and the number of consumed bytes, or 0 if the class isn't closed.
+// Like "*" a class never matches "/".
+func ignoreCharClass(glob string) (string, int) {
+	i := 1
+	negate := i < len(glob) && (glob[i] == '!' || glob[i] == '^')
+	if negate {
+		i++
+	}
+	var ranges [][2]rune
+	for first := true; ; first = false {
+		if i >= len(glob) {
+			return "", 0
+		}
+		if glob[i] == ']' && !first {
+			i++
+			break
+		}
+		if strings.HasPrefix(glob[i:], "[:") {
+			if end := strings.Index(glob[i+2:], ":]"); end >= 0 {
+				if class, ok := posixClasses[glob[i+2:i+2+end]]; ok {
+					ranges = append(ranges, class...)
+					i += end + 4
+					continue
+				}
+			}
+		}
+		lo, n := classRune(glob[i:])
+		i += n
+		hi := lo
+		if i+1 < len(glob) && glob[i] == '-' && glob[i+1] != ']' {
+			hi, n = classRune(glob[i+1:])
+			i += n + 1
+		}
+		if lo <= hi { // a reversed range matches nothing
+			ranges = append(ranges, [2]rune{lo, hi})
+		}
+	}
+
+	var class strings.Builder
+	add := func(lo, hi rune) {
+		fmt.Fprintf(&class, `\x{%x}-\x{%x}`, lo, hi)
+	}
+	for _, r := range ranges {
+		if negate || r[1] < '/' || r[0] > '/' {
+			add(r[0], r[1])
+			continue
+		}
+		if r[0] < '/' {
+			add(r[0], '/'-1)
+		}
+		if r[1] > '/' {
+			add('/'+1, r[1])
+		}
+	}
+	switch {
+	case negate:
+		return "[^/" + class.String() + "]", i
+	case class.Len() == 0:
+		return `[^\x00-\x{10ffff}]`, i // only "/", matches nothing
+	}
+	return "[" + class.String() + "]", i
+}
+
+// matchSelf returns the last rule matching relPath itself, ancestors aren't
+// looked at
+func (m *ignoreMatcher) matchSelf(relPath string, isDir bool) *ignoreRule {
+	for i := len(m.rules) - 1; i >= 0; i-- {
+		rule := m.rules[i]
+		if rule.DirOnly && !isDir {
+			continue
+		}
+		p := relPath
+		if rule.Base != "" {
+			if !strings.HasPrefix(p, rule.Base+"/") {
+				continue
+			}
+			p = p[len(rule.Base)+1:]
+		}
+		if rule.rx.MatchString(p) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// match returns whether relPath is matched and the deciding rule (nil if no
+// rule matched). Like git, a path inside a matched directory is matched too,
+// negating the path itself doesn't change that.
+func (m *ignoreMatcher) match(relPath string, isDir bool) (bool, *ignoreRule) {
+	relPath = strings.Trim(strings.TrimPrefix(relPath, "./"), "/")
+	if relPath == "" || relPath == "." {
+		return false, nil
+	}
+
+	parts := strings.Split(relPath, "/")
+	for i := 1; i < len(parts); i++ {
+		if rule := m.matchSelf(strings.Join(parts[:i], "/"), true); rule != nil && !rule.Negate {
+			return true, rule
+		}
+	}
+
+	rule := m.matchSelf(relPath, isDir)
+	if rule == nil {
+		return false, nil
+	}
+	return !rule.Negate, rule
+}
+
+var (
+	matcherCacheLock sync.Mutex
+	matcherCache     = map[string]*ignoreMatcher{}
+)
+
+// cachedIgnoreMatcher compiles patterns once
+func cachedIgnoreMatcher(patterns []string) *ignoreMatcher {
+	key := strings.Join(patterns, "\x00")
+
+	matcherCacheLock.Lock()
+	defer matcherCacheLock.Unlock()
+
+	m, ok := matcherCache[key]
+	if !ok {
+		m = newIgnoreMatcher(patterns)
+		matcherCache[key] = m
+	}
+	return m
+}
+
+// gitDirRule is reported for .git directories which git always ignores
+var gitDirRule = &ignoreRule{Pattern: ".git/", DirOnly: true, Source: "git"}
+
+// gitignoreSet lazily loads every .gitignore (and .git/info/exclude) of a
+// repository while the tree is walked, rules of a .gitignore only apply below
+// its directory
+type gitignoreSet struct {
+	root    string // repository root, or the walked directory if there's none
+	matcher *ignoreMatcher
+	loaded  map[string]bool // directories (relative to root) already looked at
+
+	lock sync.Mutex
+}
+
+// newGitignoreSet finds the repository containing dir
+func newGitignoreSet(dir string) (*gitignoreSet, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	s := &gitignoreSet{
+		root:    abs,
+		matcher: &ignoreMatcher{},
+		loaded:  map[string]bool{},
+	}
+
+	for d := abs; ; {
+		if _, err := os.Stat(filepath.Join(d, ".git")); err == nil {
+			s.root = d
+			// lowest precedence, so it's loaded first
+			exclude := filepath.Join(d, ".git", "info", "exclude")
+			if err := s.loadFile(exclude, ""); err != nil {
+				return nil, err
+			}
+			break
+		}
+		parent := filepath.Dir(d)
+		if parent == d {
+			break // not in a repository, only honor the .gitignore files below dir
+		}
+		d = parent
+	}
+	common.Debugf("Gitignore root: %s\n", s.root)
+	return s, nil
+}
+
+// loadFile adds the rules of a .gitignore like file relative to base
+func (s *gitignoreSet) loadFile(file string, base string) error {
+	b, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	common.Debugf("Loading %s\n", file)
+	for i, line := range strings.Split(string(b), "\n") {
+		s.matcher.add(strings.TrimSuffix(line, "\r"), base, file, i+1)
+	}
+	return nil
+}
+
+// ignored returns true if p is ignored by a .gitignore, the .gitignore
+// files of all its parent directories are loaded on demand
+func (s *gitignoreSet) ignored(p string, isDir bool) (bool, *ignoreRule, error) {
+	if s == nil {
+		return false, nil, nil
+	}
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return false, nil, err
+	}
+	rel, err := filepath.Rel(s.root, abs)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return false, nil, nil // outside of the repository
+	}
+	rel = filepath.ToSlash(rel)
+	if isDir && path.Base(rel) == ".git" {
+		return true, gitDirRule, nil // git never looks inside its own directory
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	dir := ""
+	parts := strings.Split(rel, "/")
+	for i := 0; i < len(parts); i++ {
+		if i > 0 {
+			dir = path.Join(dir, parts[i-1])
+		}
+		if s.loaded[dir] {
+			continue
+		}
+		s.loaded[dir] = true
+		if err := s.loadFile(filepath.Join(s.root, filepath.FromSlash(dir), ".gitignore"), dir); err != nil {
+			return false, nil, err
+		}
+	}
+
+	ignored, rule := s.matcher.match(rel, isDir)
+	return ignored, rule, nil
+}
@@ -0,0 +1,143 @@
+package filetree
+
+import (
+	"errors"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// gitignoreCases are checked against git check-ignore too if git is there
+var gitignoreCases = []struct {
+	ignore string // the .gitignore
+	path   string
+	dir    bool
+	want   bool
+}{
+	// anchoring: a slash at the start or in the middle anchors a pattern
+	{"foo", "foo", false, true},
+	{"foo", "a/foo", false, true},
+	{"foo", "foo/bar", false, true},
+	{"/foo", "foo", false, true},
+	{"/foo", "a/foo", false, false},
+	{"a/foo", "a/foo", false, true},
+	{"a/foo", "b/a/foo", false, false},
+	{"*.log", "x/y/z.log", false, true},
+	{"a/*.log", "a/b/z.log", false, false},
+
+	// leading "**/" matches in all directories
+	{"**/foo", "foo", false, true},
+	{"**/foo", "a/b/foo", false, true},
+	{"**/a/foo", "x/a/foo", false, true},
+	{"**/a/foo", "x/b/foo", false, false},
+
+	// trailing "/**" matches everything inside, but not the directory itself
+	{"abc/**", "abc/x", false, true},
+	{"abc/**", "abc/x/y", false, true},
+	{"abc/**", "abc", true, false},
+	{"abc/**", "x/abc/y", false, false},
+
+	// "/**/" matches zero or more directories
+	{"a/**/b", "a/b", false, true},
+	{"a/**/b", "a/x/b", false, true},
+	{"a/**/b", "a/x/y/b", false, true},
+	{"a/**/b", "ab", false, false},
+	{"a/**/b", "x/a/b", false, false},
+
+	// negation, the last matching pattern wins
+	{"*.log\n!keep.log", "x.log", false, true},
+	{"*.log\n!keep.log", "keep.log", false, false},
+	{"*.log\n!keep.log", "d/keep.log", false, false},
+	{"!keep.log\n*.log", "keep.log", false, true},
+
+	// a file can't be re-included if its directory is excluded
+	{"build/\n!build/keep.txt", "build/keep.txt", false, true},
+	{"build\n!build/keep.txt", "build/keep.txt", false, true},
+	{"build/*\n!build/keep.txt", "build/keep.txt", false, false},
+	{"build/*\n!build/keep.txt", "build/other.txt", false, true},
+
+	// a trailing slash only matches directories
+	{"foo/", "foo", true, true},
+	{"foo/", "foo", false, false},
+	{"foo/", "a/foo", true, true},
+	{"foo/", "foo/bar", false, true},
+	{"a/b/", "x/a/b", true, false},
+
+	// escapes and trailing spaces
+	{"#file", "#file", false, false},
+	{`\#file`, "#file", false, true},
+	{`\!important`, "!important", false, true},
+	{"trail   ", "trail", false, true},
+	{`sp\ `, "sp ", false, true},
+	{`sp\ `, "sp", false, false},
+	{`a\*b`, "a*b", false, true},
+	{`a\*b`, "axb", false, false},
+
+	// wildcards and character classes never match "/"
+	{"a?c", "abc", false, true},
+	{"a?c", "a/c", false, false},
+	{"a*c", "a/c", false, false},
+	{"[abc].txt", "a.txt", false, true},
+	{"[abc].txt", "d.txt", false, false},
+	{"[!abc].txt", "d.txt", false, true},
+	{"[!abc].txt", "a.txt", false, false},
+	{"[^abc].txt", "d.txt", false, true},
+	{"[a-c]x", "bx", false, true},
+	{"[a-c]x", "dx", false, false},
+	{"x[a-]y", "x-y", false, true},
+	{"x[]a]y", "x]y", false, true},
+	{"x[a/]y", "xay", false, true},
+	{"x[a/]y", "x/y", false, false},
+	{"x[!a]y", "x/y", false, false},
+	{"x[.-0]y", "x.y", false, true},
+	{"x[.-0]y", "x0y", false, true},
+	{"x[.-0]y", "x/y", false, false},
+	{"x[[:punct:]]y", "x-y", false, true},
+	{"x[[:punct:]]y", "x/y", false, false},
+	{"[[:digit:]].txt", "1.txt", false, true},
+	{"[[:digit:]].txt", "a.txt", false, false},
+	{"[[:upper:][:digit:]]x", "Bx", false, true},
+	{"[[:upper:][:digit:]]x", "bx", false, false},
+}
+
+func TestIgnoreMatcher(t *testing.T) {
+	for _, c := range gitignoreCases {
+		m := &ignoreMatcher{}
+		for i, line := range strings.Split(c.ignore, "\n") {
+			m.add(line, "", ".gitignore", i+1)
+		}
+		if got, _ := m.match(c.path, c.dir); got != c.want {
+			t.Errorf("%q: %s (dir %v) ignored %v, want %v", c.ignore, c.path, c.dir, got, c.want)
+		}
+	}
+}
+
+// The cases have to agree with git itself
+func TestIgnoreCasesAgainstGit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	for _, c := range gitignoreCases {
+		dir := t.TempDir()
+		if _, err := runGit(dir, "init", "-q"); err != nil {
+			t.Fatal(err)
+		}
+		writeTestFiles(t, dir, map[string]string{".gitignore": c.ignore + "\n"})
+		full := filepath.Join(dir, filepath.FromSlash(c.path))
+		if c.dir {
+			writeTestFiles(t, full, map[string]string{"file": ""})
+		} else {
+			writeTestFiles(t, dir, map[string]string{c.path: ""})
+		}
+
+		err := exec.Command("git", "-C", dir, "check-ignore", "-q", c.path).Run()
+		var exitErr *exec.ExitError
+		if err != nil && (!errors.As(err, &exitErr) || exitErr.ExitCode() != 1) {
+			t.Fatal(err)
+		}
+		if got := err == nil; got != c.want {
+			t.Errorf("git: %q: %s (dir %v) ignored %v, want %v", c.ignore, c.path, c.dir, got, c.want)
+		}
+	}
+}
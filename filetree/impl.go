@@ -5,12 +5,11 @@ import (
 	"os"
 	"path"
 	"path/filepath"
-	"regexp"
 	"strings"
+	"time"
 	"unicode/utf8"
 
 	"github.com/mrvnmyr/oat/common"
-	"gopkg.in/yaml.v3"
 )
 
 var (
@@ -25,76 +24,136 @@ var (
 	AllowedGlobs []string = []string{}
 
 	SkipBinaryFiles bool = true
+
+	// NoHash omits the content hashes expand uses to detect conflicts
+	NoHash bool = false
+
+	// NoGitignore disables honoring .gitignore files and .git/info/exclude
+	NoGitignore bool = false
 )
 
-// shouldIgnore returns true if relPath matches any glob.
-func shouldIgnore(relPath string) bool {
-	relPath = strings.TrimPrefix(relPath, "./")
-	relPathSlash := relPath
-	if !strings.HasSuffix(relPathSlash, "/") && isDirGlobMatch(relPath) {
-		relPathSlash += "/"
+// shouldIgnore returns true if relPath is matched by IgnoredGlobs.
+func shouldIgnore(relPath string, isDir bool) bool {
+	ignored, _ := cachedIgnoreMatcher(IgnoredGlobs).match(relPath, isDir)
+	return ignored
+}
+
+// shouldAllow returns true if relPath is matched by AllowedGlobs, or if the list is empty.
+func shouldAllow(relPath string, isDir bool) bool {
+	if len(AllowedGlobs) == 0 {
+		return true
 	}
+	allowed, _ := cachedIgnoreMatcher(AllowedGlobs).match(relPath, isDir)
+	return allowed
+}
 
-	match := func(glob string) bool {
-		if strings.HasSuffix(glob, "/") {
-			if strings.HasPrefix(relPathSlash, glob) {
-				return true
-			}
-		}
-		ok, err := path.Match(glob, relPath)
-		if err == nil && ok {
-			return true
-		}
-		return false
+// excludeReason returns why the walk leaves out relPath (at pathStr on disk)
+// because of IgnoredGlobs, a .gitignore or the allow list, "" if it doesn't.
+// Directories aren't checked against the allow list.
+func excludeReason(pathStr string, relPath string, isDir bool, gitignores *gitignoreSet, selection map[string]bool) (string, error) {
+	if ignored, rule := cachedIgnoreMatcher(IgnoredGlobs).match(relPath, isDir); ignored {
+		return "ignored by " + rule.describe(), nil
+	}
+	if ignored, rule, err := gitignores.ignored(pathStr, isDir); err != nil {
+		return "", err
+	} else if ignored {
+		return "ignored by " + rule.describe(), nil
+	}
+	if !isDir && !isSelected(relPath, selection) {
+		return notSelectedReason(selection), nil
 	}
+	return "", nil
+}
 
-	for _, glob := range IgnoredGlobs {
-		if match(glob) {
-			return true
-		}
+// notSelectedReason explains why isSelected returned false
+func notSelectedReason(selection map[string]bool) string {
+	if selection != nil {
+		return "not selected by --git-tracked/--git-changed/--git-staged"
 	}
-	return false
+	return "not matched by .flattenallow/--allowed-globs"
 }
 
-// shouldAllow returns true if relPath matches any glob in AllowedGlobs, or if the list is empty.
-func shouldAllow(relPath string) bool {
-	if len(AllowedGlobs) == 0 {
-		return true
+// EntryTypeSymlink marks entries that are symlinks, Target is where they point to
+const EntryTypeSymlink = "symlink"
+
+type Entry struct {
+	Type     string `yaml:"type,omitempty" json:"type,omitempty"` // empty for regular files
+	Target   string `yaml:"target,omitempty" json:"target,omitempty"`
+	Perm     string `yaml:"perm,omitempty" json:"perm,omitempty"`
+	Hash     string `yaml:"hash,omitempty" json:"hash,omitempty"`         // xxhash of the (decoded) content when it was flattened
+	Size     int64  `yaml:"size,omitempty" json:"size,omitempty"`         // in bytes, with --metadata or before truncating
+	MTime    string `yaml:"mtime,omitempty" json:"mtime,omitempty"`       // RFC 3339, only with --metadata
+	Encoding string `yaml:"encoding,omitempty" json:"encoding,omitempty"` // utf8 (empty) or base64 for binary files
+	Content  string `yaml:"content" json:"content"`
+
+	Truncated bool `yaml:"truncated,omitempty" json:"truncated,omitempty"` // parts of the content were left out, expand won't write it
+
+	Delete      bool   `yaml:"delete,omitempty" json:"delete,omitempty"`             // expand removes the file
+	RenamedFrom string `yaml:"renamed_from,omitempty" json:"renamed_from,omitempty"` // expand moves this file here, an empty content keeps the old one
+
+	modTime time.Time // of the file it was read from, archives use it without --metadata
+}
+
+func (e Entry) isSymlink() bool {
+	return e.Type == EntryTypeSymlink
+}
+
+// readEntry reads the file at pathStr (keyed relPath), ok is false for binary
+// files that are skipped. Symlinks that weren't followed become symlink entries.
+func readEntry(pathStr string, relPath string, info os.FileInfo) (Entry, bool, error) {
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(pathStr)
+		if err != nil {
+			return Entry{}, false, err
+		}
+		return Entry{Type: EntryTypeSymlink, Target: filepath.ToSlash(target)}, true, nil
 	}
-	relPath = strings.TrimPrefix(relPath, "./")
-	relPathSlash := relPath
-	if !strings.HasSuffix(relPathSlash, "/") && isDirGlobMatch(relPath) {
-		relPathSlash += "/"
+	_, truncate, reason, err := fileVerdict(pathStr, relPath, info)
+	if err != nil || reason != "" {
+		return Entry{}, false, err
 	}
 
-	match := func(glob string) bool {
-		if strings.HasSuffix(glob, "/") {
-			if strings.HasPrefix(relPathSlash, glob) {
-				return true
-			}
+	var entry Entry
+	if truncate {
+		entry, err = readTruncated(pathStr, info)
+		if err != nil {
+			return Entry{}, false, err
 		}
-		ok, err := path.Match(glob, relPath)
-		if err == nil && ok {
-			return true
+	} else {
+		b, err := common.ReadFileOrStdin(pathStr)
+		if err != nil {
+			return Entry{}, false, err
 		}
-		return false
+		entry = contentEntry(fmt.Sprintf("%04o", info.Mode().Perm()), b)
 	}
-
-	for _, glob := range AllowedGlobs {
-		if match(glob) {
-			return true
-		}
+	entry.modTime = info.ModTime()
+	if Metadata {
+		entry.MTime = formatMTime(info.ModTime())
 	}
-	return false
+	return entry, true, nil
 }
 
-func isDirGlobMatch(relPath string) bool {
-	return strings.HasSuffix(relPath, "/")
-}
-
-type Entry struct {
-	Perm    string `yaml:"perm"`
-	Content string `yaml:"content"`
+// fileVerdict decides what flatten does with the file at pathStr without
+// reading more than its start: reason is why it's skipped ("" if it isn't)
+// and truncate is true if only a part of it is kept
+func fileVerdict(pathStr string, relPath string, info os.FileInfo) (binary bool, truncate bool, reason string, err error) {
+	binary, err = isLikelyBinaryFile(pathStr)
+	if err != nil {
+		return false, false, "", err
+	}
+	if binary {
+		if reason := binaryExcludeReason(relPath, info.Size()); reason != "" {
+			return binary, false, reason, nil
+		}
+	}
+	skip, truncate, err := sizeLimit(relPath, info.Size(), binary)
+	if err != nil {
+		return binary, false, "", err
+	}
+	if skip {
+		return binary, false, fmt.Sprintf("larger than --max-file-size %d", MaxFileSize), nil
+	}
+	return binary, truncate, "", nil
 }
 
 func isLikelyBinaryFile(path string) (bool, error) {
@@ -109,86 +168,37 @@ func isLikelyBinaryFile(path string) (bool, error) {
 	if err != nil && err.Error() != "EOF" {
 		return false, err
 	}
-	buf = buf[:n]
+	return isLikelyBinary(buf[:n]), nil
+}
+
+// isLikelyBinary looks at the start of a file's content
+func isLikelyBinary(buf []byte) bool {
+	const sniffLen = 8000
+	if len(buf) > sniffLen {
+		buf = buf[:sniffLen]
+	}
 
-	if n == 0 {
-		return false, nil // empty file is not binary
+	if len(buf) == 0 {
+		return false // empty file is not binary
 	}
 	if !utf8.Valid(buf) {
-		return true, nil
+		return true
 	}
 	for _, b := range buf {
 		if b == 0 {
-			return true, nil
-		}
-	}
-	return false, nil
-}
-
-func globToRegexp(glob string) string {
-	var rx strings.Builder
-	rx.WriteString("^")
-	for i := 0; i < len(glob); {
-		if strings.HasPrefix(glob[i:], "**/") {
-			rx.WriteString("(?:.*/)?")
-			i += 3
-		} else if strings.HasPrefix(glob[i:], "**") {
-			rx.WriteString(".*")
-			i += 2
-		} else {
-			switch glob[i] {
-			case '*':
-				rx.WriteString("[^/]*")
-			case '?':
-				rx.WriteString("[^/]")
-			case '.', '+', '(', ')', '$', '^', '|', '{', '}', '[', ']', '\\':
-				rx.WriteString("\\" + string(glob[i]))
-			default:
-				rx.WriteByte(glob[i])
-			}
-			i++
+			return true
 		}
 	}
-	rx.WriteString("$")
-	return rx.String()
+	return false
 }
 
-func matchIncludeOnly(relPath string, includeOnly []string) bool {
-	relPath = strings.TrimPrefix(relPath, "./")
-	relPathSlash := relPath
-	if !strings.HasSuffix(relPathSlash, "/") && isDirGlobMatch(relPath) {
-		relPathSlash += "/"
-	}
+// matchIncludeOnly returns true if relPath is matched by includeOnly, or if the list is empty.
+func matchIncludeOnly(relPath string, isDir bool, includeOnly []string) bool {
 	if len(includeOnly) == 0 {
 		return true
 	}
-	for _, pat := range includeOnly {
-		pat = strings.TrimPrefix(pat, "./")
-		if strings.HasSuffix(pat, "/") {
-			if strings.HasPrefix(relPathSlash, pat) {
-				return true
-			}
-			continue
-		}
-		if strings.Contains(pat, "**") {
-			rx := globToRegexp(pat)
-			if ok, _ := regexp.MatchString(rx, relPath); ok {
-				return true
-			}
-			continue
-		}
-		if strings.ContainsAny(pat, "*?[") {
-			ok, err := path.Match(pat, relPath)
-			if err == nil && ok {
-				return true
-			}
-			continue
-		}
-		if relPath == pat {
-			return true
-		}
-	}
-	return false
+	included, _ := cachedIgnoreMatcher(includeOnly).match(relPath, isDir)
+	return included
 }
 
 // DirTreeToYAML walks 'srcRoot' and outputs a map[path]Entry as YAML at yamlPath.
@@ -202,17 +212,42 @@ func DirTreeToYAML(srcRoot, yamlPath string, includeOnly []string, seeksDotFiles
 		common.Check(err)
 	}
 
-	tree := map[string]Entry{}
-	err = filepath.Walk(srcRoot, func(pathStr string, info os.FileInfo, err error) error {
+	files, err := collectDirFiles(srcRoot, includeOnly, seeksDotFiles)
+	if err != nil {
+		return err
+	}
+
+	templateDir := ""
+	if seeksDotFiles {
+		templateDir = srcRoot
+	}
+	return writeFiles(files, yamlPath, templateDir)
+}
+
+// collectDirFiles walks srcRoot and returns the files DirTreeToYAML flattens
+func collectDirFiles(srcRoot string, includeOnly []string, seeksDotFiles bool) ([]flattenFile, error) {
+	var err error
+	var gitignores *gitignoreSet
+	if !NoGitignore && (seeksDotFiles || shouldProcessIgnores()) {
+		gitignores, err = newGitignoreSet(srcRoot)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	selection, err := gitSelection(srcRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []flattenFile
+	err = walkTree(srcRoot, func(pathStr string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
 		if pathStr == srcRoot {
 			return nil // skip root
 		}
-		if info.Mode()&os.ModeSymlink != 0 {
-			return nil
-		}
 		if info.IsDir() {
 			relPath, err := filepath.Rel(srcRoot, pathStr)
 			if err != nil {
@@ -222,7 +257,12 @@ func DirTreeToYAML(srcRoot, yamlPath string, includeOnly []string, seeksDotFiles
 			if !seeksDotFiles && !shouldProcessIgnores() {
 				// nothing, just don't skip
 			} else {
-				if shouldIgnore(relPath) {
+				reason, err := excludeReason(pathStr, relPath, true, gitignores, selection)
+				if err != nil {
+					return err
+				}
+				if reason != "" {
+					excluded(relPath, true, reason)
 					return filepath.SkipDir
 				}
 			}
@@ -236,197 +276,236 @@ func DirTreeToYAML(srcRoot, yamlPath string, includeOnly []string, seeksDotFiles
 		if !seeksDotFiles && !shouldProcessIgnores() {
 			// skip nothing
 		} else {
-			if shouldIgnore(relPath) {
-				return nil
-			}
-			if !shouldAllow(relPath) {
-				return nil
-			}
-			if !matchIncludeOnly(relPath, includeOnly) {
-				return nil
-			}
-		}
-		if SkipBinaryFiles {
-			isBin, err := isLikelyBinaryFile(pathStr)
+			reason, err := excludeReason(pathStr, relPath, false, gitignores, selection)
 			if err != nil {
 				return err
 			}
-			if isBin {
+			if reason == "" && !matchIncludeOnly(relPath, false, includeOnly) {
+				reason = "not in the include list"
+			}
+			if reason != "" {
+				excluded(relPath, false, reason)
 				return nil
 			}
 		}
-		b, err := common.ReadFileOrStdin(pathStr)
-		if err != nil {
-			return err
-		}
-		entry := Entry{
-			Perm:    fmt.Sprintf("%04o", info.Mode().Perm()),
-			Content: string(b),
-		}
-		tree[relPath] = entry
+		files = append(files, flattenFile{Path: relPath, Full: pathStr, Info: info})
 		return nil
 	})
+	return files, err
+}
+
+// FlattenArgsToYAML handles flattening files/dirs passed as args, optionally without ignores.
+func FlattenArgsToYAML(paths []string, yamlPath string, noIgnores bool) error {
+	files, err := collectArgFiles(paths, noIgnores)
 	if err != nil {
 		return err
 	}
-	out, err := yaml.Marshal(tree)
-	if err != nil {
-		return err
-	}
+	return writeFiles(files, yamlPath, "")
+}
 
-	var result []byte
-	if LLM {
-		result = []byte("```\n")
-		result = append(result, out...)
-		result = append(result, []byte("```\n\nThis is a flattened filetree represented as a YAML.\n\nTODO\n\nImplement what is required to fix this issue and output it in the same flattened filetree YAML structure as was provided before.\n\nIf files are not changed don't output them.\n")...)
-	} else {
-		result = out
+// collectFiles returns the files flatten selects with args: DirTreeToYAML's
+// without args (templateDir is then where the .flattenignore is), else
+// FlattenArgsToYAML's
+func collectFiles(args []string, noIgnores bool) (files []flattenFile, templateDir string, err error) {
+	if len(args) == 0 {
+		srcRoot, err := findRootAndPopulateFromDotFlattenFile("")
+		if err != nil {
+			return nil, "", err
+		}
+		files, err = collectDirFiles(srcRoot, []string{}, true)
+		return files, srcRoot, err
 	}
-
-	return common.WriteFileOrStd(yamlPath, result, 0644)
+	files, err = collectArgFiles(args, noIgnores)
+	return files, "", err
 }
 
-// FlattenArgsToYAML handles flattening files/dirs passed as args, optionally without ignores.
-func FlattenArgsToYAML(paths []string, yamlPath string, noIgnores bool) error {
-	tree := map[string]Entry{}
+// collectArgFiles returns the files FlattenArgsToYAML flattens
+func collectArgFiles(paths []string, noIgnores bool) ([]flattenFile, error) {
+	var files []flattenFile
 	cwd, err := os.Getwd()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	selection, err := gitSelection(cwd)
+	if err != nil {
+		return nil, err
 	}
 	for _, root := range paths {
 		absRoot, err := filepath.Abs(root)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		isBelow, relBase := pathIsBelowCWD(absRoot, cwd)
-		err = flattenArgAddWithBase(tree, root, "", noIgnores, absRoot, isBelow, relBase)
+		if !isBelow && !AllowOutsideRoot {
+			// key the files relative to the arg's parent instead of absolute
+			isBelow, relBase = true, filepath.Dir(absRoot)
+		}
+		var gitignores *gitignoreSet
+		if !noIgnores && !NoGitignore {
+			gitignores, err = newGitignoreSet(root)
+			if err != nil {
+				return nil, err
+			}
+		}
+		err = flattenArgAddWithBase(&files, root, "", noIgnores, gitignores, selection, absRoot, isBelow, relBase)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 
-	out, err := yaml.Marshal(tree)
+	return files, nil
+}
+
+// writeTree encodes tree in OutputFormat (wrapped in the LLM prompt if
+// requested) and writes it to outPath, templateDir is searched for a
+// .flattenprompt
+func writeTree(tree map[string]Entry, outPath string, templateDir string) error {
+	result, err := renderTree(tree, templateDir)
 	if err != nil {
 		return err
 	}
-	var result []byte
-	if LLM {
-		result = []byte("```\n")
-		result = append(result, out...)
-		result = append(result, []byte("```\n\nThis is a flattened filetree represented as a YAML.\n\nTODO\n\nImplement what is required to fix this issue and output it in the same flattened filetree YAML structure as was provided before.\n\nIf files are not changed don't output them.\n")...)
-	} else {
-		result = out
+	return common.WriteFileOrStd(outPath, result, 0644)
+}
+
+// renderTree is writeTree without writing, it returns the output
+func renderTree(tree map[string]Entry, templateDir string) ([]byte, error) {
+	if wantsPrompt() && isArchiveFormat(OutputFormat) {
+		return nil, fmt.Errorf("--llm can't be used with the %s format", OutputFormat)
 	}
-	return common.WriteFileOrStd(yamlPath, result, 0644)
+
+	for _, p := range sortedPaths(tree) {
+		entry, err := finishEntry(p, tree[p])
+		if err != nil {
+			return nil, err
+		}
+		tree[p] = entry
+	}
+
+	render := func(tree map[string]Entry) ([]byte, error) {
+		out, err := encodeTree(tree, OutputFormat)
+		if err != nil {
+			return nil, err
+		}
+		if wantsPrompt() {
+			return renderPrompt(tree, out, templateDir)
+		}
+		return out, nil
+	}
+
+	result, tree, dropped, err := applyTokenBudget(tree, render)
+	if err != nil {
+		return nil, err
+	}
+	if TokenReport {
+		if err := reportTokens(tree, dropped, result); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// finishEntry adds the hash and metadata that are computed from the content
+// and masks secrets
+func finishEntry(p string, entry Entry) (Entry, error) {
+	// truncated entries carry the hash and size of the whole file
+	if !entry.isSymlink() && !entry.Truncated && (!NoHash || Metadata) {
+		content, err := entry.decodedContent()
+		if err != nil {
+			return entry, fmt.Errorf("%s: %w", p, err)
+		}
+		if !NoHash {
+			entry.Hash = contentHash(content)
+		}
+		if Metadata {
+			entry.Size = int64(len(content))
+		}
+	}
+	if redactEnabled() {
+		return redactEntry(p, entry)
+	}
+	return entry, nil
 }
 
 // Helper for FlattenArgsToYAML: handles one file/dir, recursively, using absRoot/isBelowCWD info
-func flattenArgAddWithBase(tree map[string]Entry, src string, prefix string, noIgnores bool, absRoot string, isBelow bool, relBase string) error {
+func flattenArgAddWithBase(files *[]flattenFile, src string, prefix string, noIgnores bool, gitignores *gitignoreSet, selection map[string]bool, absRoot string, isBelow bool, relBase string) error {
 	common.Debugf("Flatten: %s\n", src)
 	info, err := os.Lstat(src)
 	if err != nil {
 		return err
 	}
-	if info.Mode()&os.ModeSymlink != 0 {
-		return nil
+	if FollowSymlinks && info.Mode()&os.ModeSymlink != 0 {
+		info = followSymlink(src, info, nil)
 	}
-	if info.IsDir() {
-		return filepath.Walk(src, func(pathStr string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-			if info.IsDir() {
-				return nil
-			}
-			absPath, err := filepath.Abs(pathStr)
-			if err != nil {
-				return err
-			}
-			var relPath string
-			if isBelow {
-				rp, err := filepath.Rel(relBase, absPath)
-				if err != nil {
-					return err
-				}
-				relPath = filepath.ToSlash(rp)
-			} else {
-				relPath = filepath.ToSlash(absPath)
-			}
-			if prefix != "" {
-				relPath = path.Join(prefix, relPath)
-			}
-			if !noIgnores {
-				if shouldIgnore(relPath) {
-					return nil
-				}
-				if !shouldAllow(relPath) {
-					return nil
-				}
-			}
-			if SkipBinaryFiles {
-				isBin, err := isLikelyBinaryFile(pathStr)
-				if err != nil {
-					return err
-				}
-				if isBin {
-					return nil
-				}
-			}
-			b, err := common.ReadFileOrStdin(pathStr)
-			if err != nil {
-				return err
-			}
-			tree[relPath] = Entry{
-				Perm:    fmt.Sprintf("%04o", info.Mode().Perm()),
-				Content: string(b),
-			}
-			return nil
-		})
-	} else {
-		absPath, err := filepath.Abs(src)
+
+	keyOf := func(pathStr string) (string, error) {
+		absPath, err := filepath.Abs(pathStr)
 		if err != nil {
-			return err
+			return "", err
 		}
-		var relPath string
+		relPath := filepath.ToSlash(absPath)
 		if isBelow {
 			rp, err := filepath.Rel(relBase, absPath)
 			if err != nil {
-				return err
+				return "", err
 			}
 			relPath = filepath.ToSlash(rp)
-		} else {
-			relPath = filepath.ToSlash(absPath)
-		}
-		if prefix != "" {
-			relPath = path.Join(prefix, filepath.Base(src))
 		}
+		return relPath, nil
+	}
+	add := func(pathStr string, relPath string, info os.FileInfo) error {
+		reason := ""
 		if !noIgnores {
-			if shouldIgnore(relPath) {
-				return nil
-			}
-			if !shouldAllow(relPath) {
-				return nil
+			reason, err = excludeReason(pathStr, relPath, false, gitignores, selection)
+			if err != nil {
+				return err
 			}
+		} else if selection != nil && !selection[relPath] {
+			reason = notSelectedReason(selection)
+		}
+		if reason != "" {
+			excluded(relPath, false, reason)
+			return nil
 		}
-		if SkipBinaryFiles {
-			isBin, err := isLikelyBinaryFile(src)
+		*files = append(*files, flattenFile{Path: relPath, Full: pathStr, Info: info})
+		return nil
+	}
+
+	if info.IsDir() {
+		return walkTree(src, func(pathStr string, info os.FileInfo, err error) error {
 			if err != nil {
 				return err
 			}
-			if isBin {
+			if info.IsDir() {
+				if !noIgnores {
+					if ignored, rule, err := gitignores.ignored(pathStr, true); err != nil {
+						return err
+					} else if ignored {
+						if relPath, err := keyOf(pathStr); err == nil {
+							excluded(path.Join(prefix, relPath), true, "ignored by "+rule.describe())
+						}
+						return filepath.SkipDir
+					}
+				}
 				return nil
 			}
-		}
-		b, err := common.ReadFileOrStdin(src)
-		if err != nil {
-			return err
-		}
-		tree[relPath] = Entry{
-			Perm:    fmt.Sprintf("%04o", info.Mode().Perm()),
-			Content: string(b),
-		}
+			relPath, err := keyOf(pathStr)
+			if err != nil {
+				return err
+			}
+			if prefix != "" {
+				relPath = path.Join(prefix, relPath)
+			}
+			return add(pathStr, relPath, info)
+		})
 	}
-	return nil
+	relPath, err := keyOf(src)
+	if err != nil {
+		return err
+	}
+	if prefix != "" {
+		relPath = path.Join(prefix, filepath.Base(src))
+	}
+	return add(src, relPath, info)
 }
 
 // Returns (isBelowCWD, relBase)
@@ -439,7 +518,7 @@ func pathIsBelowCWD(absTarget string, cwd string) (bool, string) {
 	if err != nil {
 		return false, cwdAbs
 	}
-	if !strings.HasPrefix(rel, "..") && rel != "." {
+	if rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
 		return true, cwdAbs
 	}
 	return false, cwdAbs
@@ -451,6 +530,17 @@ func shouldProcessIgnores() bool {
 	return true
 }
 
+// hasDotFlattenFile returns true if there is a .flattenignore or
+// .flattenallow directly in dir
+func hasDotFlattenFile(dir string) bool {
+	for _, name := range []string{".flattenignore", ".flattenallow"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
 func findRootAndPopulateFromDotFlattenFile(srcRoot string) (string, error) {
 	cwd, err := os.Getwd()
 	if err != nil {
@@ -459,6 +549,11 @@ func findRootAndPopulateFromDotFlattenFile(srcRoot string) (string, error) {
 
 	// Walk upwards looking for either .flattenignore or .flattenallow
 	dir := cwd
+	if srcRoot != "" {
+		if dir, err = filepath.Abs(srcRoot); err != nil {
+			return srcRoot, err
+		}
+	}
 
 	fillVar := func(path string, variable *[]string) (found bool, err error) {
 		if _, err := os.Stat(path); err == nil {
@@ -472,8 +567,9 @@ func findRootAndPopulateFromDotFlattenFile(srcRoot string) (string, error) {
 			{ // process the lines, handle '#' comments and '< file' to insert file contents
 				var processLines func([]string, string) error
 
-				processLines = func(lines []string, dir string) error {
-					for _, line := range lines {
+				processLines = func(lines []string, file string) error {
+					dir := filepath.Dir(file)
+					for i, line := range lines {
 						line = strings.TrimSpace(line)
 						if line == "" || strings.HasPrefix(line, "#") {
 							continue
@@ -490,18 +586,19 @@ func findRootAndPopulateFromDotFlattenFile(srcRoot string) (string, error) {
 							}
 							insertedLines := strings.Split(string(inserted), "\n")
 							// recurse to process included lines (may include more < ...)
-							if err := processLines(insertedLines, filepath.Dir(insertPath)); err != nil {
+							if err := processLines(insertedLines, insertPath); err != nil {
 								return err
 							}
 							continue
 						}
 						*variable = append(*variable, line)
+						globOrigins[line] = fmt.Sprintf("%s:%d", file, i+1)
 					}
 					return nil
 				}
 
 				*variable = []string{}
-				if err := processLines(strings.Split(string(lines), "\n"), filepath.Dir(path)); err != nil {
+				if err := processLines(strings.Split(string(lines), "\n"), path); err != nil {
 					return false, err
 				}
 			}
@@ -516,11 +613,15 @@ func findRootAndPopulateFromDotFlattenFile(srcRoot string) (string, error) {
 		foundAny := false
 
 		found, err := fillVar(filepath.Join(dir, ".flattenignore"), &IgnoredGlobs)
-		common.Check(err)
+		if err != nil {
+			return srcRoot, err
+		}
 		foundAny = foundAny || found
 
 		found, err = fillVar(filepath.Join(dir, ".flattenallow"), &AllowedGlobs)
-		common.Check(err)
+		if err != nil {
+			return srcRoot, err
+		}
 		foundAny = foundAny || found
 
 		if foundAny {
@@ -537,30 +638,45 @@ func findRootAndPopulateFromDotFlattenFile(srcRoot string) (string, error) {
 	return srcRoot, nil
 }
 
-// YAMLToDirTree reads YAML file describing a tree and creates files under destRoot.
+// YAMLToDirTree reads a YAML file (or any other InputFormat) describing a tree
+// and creates files under destRoot.
 // Directories are not created unless needed for files.
 func YAMLToDirTree(yamlPath, destRoot string) error {
 	data, err := common.ReadFileOrStdin(yamlPath)
 	if err != nil {
 		return err
 	}
-	tree := map[string]Entry{}
-	if err := yaml.Unmarshal(data, &tree); err != nil {
+	var tree map[string]Entry
+	var cut []string
+	if InputFormat != "" {
+		tree, err = decodeTree(data, InputFormat)
+	} else {
+		tree, cut, err = extractTree(data)
+	}
+	if err != nil {
 		return err
 	}
-	for f, entry := range tree {
-		full := filepath.Join(destRoot, filepath.FromSlash(f))
-		if err := os.MkdirAll(filepath.Dir(full), 0o755); err != nil {
-			return err
-		}
-		if err := common.WriteFileOrStd(full, []byte(entry.Content), 0o644); err != nil {
+	for _, p := range cut {
+		fmt.Fprintf(os.Stderr, "skipping: %s is cut off\n", p)
+	}
+
+	var base map[string]Entry
+	if BasePath != "" {
+		data, err := common.ReadFileOrStdin(common.ExpandHome(BasePath))
+		if err != nil {
 			return err
 		}
-		perm, _ := parsePerm(entry.Perm)
-		if err := os.Chmod(full, perm); err != nil {
-			return err
+		base, err = decodeTree(data, "")
+		if err != nil {
+			return fmt.Errorf("reading base %s: %w", BasePath, err)
 		}
 	}
+	if err := expandTree(tree, destRoot, yamlPath, base); err != nil {
+		return err
+	}
+	if len(cut) > 0 {
+		return fmt.Errorf("%d entries were cut off and not written", len(cut))
+	}
 	return nil
 }
 
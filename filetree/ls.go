@@ -0,0 +1,215 @@
+package filetree
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// onExcluded is called for every path the walk leaves out, ls sets it
+var onExcluded func(relPath string, isDir bool, reason string)
+
+// excluded reports a path the walk leaves out
+func excluded(relPath string, isDir bool, reason string) {
+	if onExcluded != nil {
+		onExcluded(relPath, isDir, reason)
+	}
+}
+
+// lsItem is a file or directory in the output of ls
+type lsItem struct {
+	IsDir  bool
+	Size   int64
+	Tokens int
+	Files  int      // included files, for directories the ones below it
+	Flags  []string // binary, truncated, symlink to ...
+	Reason string   // why it's excluded, "" if it's included
+
+	children map[string]*lsItem
+}
+
+// add returns the item for relPath, creating it and its parents
+func (it *lsItem) add(relPath string, isDir bool) *lsItem {
+	parts := strings.Split(strings.Trim(relPath, "/"), "/")
+	for i, name := range parts {
+		child, ok := it.children[name]
+		if !ok {
+			child = &lsItem{IsDir: isDir || i < len(parts)-1, children: map[string]*lsItem{}}
+			it.children[name] = child
+		}
+		it = child
+	}
+	return it
+}
+
+// sum adds up the included files below a directory, it returns how many
+// paths were excluded
+func (it *lsItem) sum() int {
+	excludedCount := 0
+	for _, child := range it.children {
+		if child.Reason != "" {
+			excludedCount++
+			continue
+		}
+		if child.IsDir {
+			excludedCount += child.sum()
+		}
+		it.Size += child.Size
+		it.Tokens += child.Tokens
+		it.Files += child.Files
+	}
+	return excludedCount
+}
+
+// describe returns what ls prints after the name
+func (it *lsItem) describe() string {
+	if it.Reason != "" {
+		return "excluded: " + it.Reason
+	}
+	details := fmt.Sprintf("%s  ~%d tokens", humanSize(it.Size), it.Tokens)
+	if it.IsDir {
+		files := "files"
+		if it.Files == 1 {
+			files = "file"
+		}
+		details = fmt.Sprintf("%d %s  %s", it.Files, files, details)
+	}
+	if len(it.Flags) > 0 {
+		details += "  [" + strings.Join(it.Flags, ", ") + "]"
+	}
+	return details
+}
+
+// names returns the names of the children of it, sorted
+func (it *lsItem) names() []string {
+	names := make([]string, 0, len(it.children))
+	for name := range it.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// walk calls fn for every item below it in the order print prints them,
+// excluded directories aren't descended into
+func (it *lsItem) walk(prefix string, fn func(relPath string, item *lsItem)) {
+	for _, name := range it.names() {
+		child := it.children[name]
+		fn(prefix+name, child)
+		if child.Reason == "" {
+			child.walk(prefix+name+"/", fn)
+		}
+	}
+}
+
+// print writes the children of it as a tree
+func (it *lsItem) print(w io.Writer, indent string) {
+	names := it.names()
+	for i, name := range names {
+		child := it.children[name]
+		branch, next := "├── ", "│   "
+		if i == len(names)-1 {
+			branch, next = "└── ", "    "
+		}
+		if child.IsDir {
+			name += "/"
+		}
+		fmt.Fprintf(w, "%s%s%s  %s\n", indent, branch, name, child.describe())
+		if child.Reason == "" {
+			child.print(w, indent+next)
+		}
+	}
+}
+
+// humanSize formats a size in bytes
+func humanSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	value, suffix := float64(n)/unit, "KiB"
+	for _, s := range []string{"MiB", "GiB", "TiB"} {
+		if value < unit {
+			break
+		}
+		value, suffix = value/unit, s
+	}
+	return fmt.Sprintf("%.1f %s", value, suffix)
+}
+
+// ListTree prints the files flatten would include with the same arguments and
+// flags as a tree, with their sizes and estimated tokens, and why every other
+// path is left out. File contents aren't read, only their start to tell
+// binary files apart, so the tokens are estimated from the sizes.
+func ListTree(paths []string, noIgnores bool) error {
+	root, excludedCount, err := listTree(paths, noIgnores)
+	if err != nil {
+		return err
+	}
+	fmt.Println(".")
+	root.print(os.Stdout, "")
+	fmt.Fprintf(os.Stderr, "%d files, %s, ~%d tokens, %d excluded\n", root.Files, humanSize(root.Size), root.Tokens, excludedCount)
+	return nil
+}
+
+// listTree returns the tree ListTree prints and how many paths are excluded
+func listTree(paths []string, noIgnores bool) (*lsItem, int, error) {
+	t, err := currentTokenizer()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	root := &lsItem{IsDir: true, children: map[string]*lsItem{}}
+	onExcluded = func(relPath string, isDir bool, reason string) {
+		root.add(relPath, isDir).Reason = reason
+	}
+	defer func() { onExcluded = nil }()
+
+	files, _, err := collectFiles(paths, noIgnores)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	for _, f := range sortFiles(files) {
+		item := root.add(f.Path, false)
+		item.Size = f.Info.Size()
+		if f.Info.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(f.Full)
+			if err != nil {
+				return nil, 0, err
+			}
+			target = filepath.ToSlash(target)
+			item.Size = 0
+			item.Flags = append(item.Flags, "symlink to "+target)
+			item.Tokens = t.CountTokens(f.Path) + t.CountTokens(target) + 4
+			item.Files = 1
+			continue
+		}
+
+		binary, truncate, reason, err := fileVerdict(f.Full, f.Path, f.Info)
+		if err != nil {
+			return nil, 0, err
+		}
+		if reason != "" {
+			item.Reason = reason
+			continue
+		}
+		contentSize := item.Size
+		if binary {
+			item.Flags = append(item.Flags, "binary")
+			contentSize = (contentSize + 2) / 3 * 4 // base64
+		}
+		if truncate {
+			item.Flags = append(item.Flags, "truncated")
+			contentSize = MaxFileSize
+		}
+		// like entryTokens, with the content estimated at 4 bytes per token
+		item.Tokens = t.CountTokens(f.Path) + int((contentSize+3)/4) + 4
+		item.Files = 1
+	}
+
+	return root, root.sum(), nil
+}
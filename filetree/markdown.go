@@ -0,0 +1,291 @@
+package filetree
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+)
+
+const defaultPerm = "0644"
+
+var (
+	reMarkdownHeading = regexp.MustCompile(`^#{1,6}\s+(.+?)\s*$`)
+	reMarkdownFence   = regexp.MustCompile("^(`{3,}|~{3,})\\s*([^`\\s]*)")
+	reMarkdownPerm    = regexp.MustCompile(`^(.+?)\s+\(([0-7]{3,4})\)$`)
+	reMarkdownDeleted = regexp.MustCompile(`^(.+?)\s+\(deleted\)$`)
+	reMarkdownRenamed = regexp.MustCompile(`^(.+?)\s+\(renamed from (.+)\)$`)
+	reMarkdownSymlink = regexp.MustCompile(`^(.+?)\s+\(symlink to (.+)\)$`)
+	reMarkdownBase64  = regexp.MustCompile(`^(.+?)\s+\(base64\)$`)
+	reMarkdownTrunc   = regexp.MustCompile(`^(.+?)\s+\(truncated\)$`)
+	reMarkdownNoEOL   = regexp.MustCompile(`^(.+?)\s+\(no final newline\)$`)
+	reMarkdownTree    = regexp.MustCompile("(?m)^#{1,6} \\S.*(?:\\((?:deleted|renamed from .+|symlink to .+)\\)[ \\t]*$|\\n(?:[ \\t]*\\n)*(?:```|~~~))")
+	reBacktickRun     = regexp.MustCompile("`{3,}")
+)
+
+// markdownLanguages maps file extensions (or whole file names) to the
+// language tag of the code fence
+var markdownLanguages = map[string]string{
+	".c":         "c",
+	".cc":        "cpp",
+	".cpp":       "cpp",
+	".cs":        "csharp",
+	".css":       "css",
+	".go":        "go",
+	".h":         "c",
+	".hpp":       "cpp",
+	".html":      "html",
+	".java":      "java",
+	".js":        "javascript",
+	".json":      "json",
+	".jsonl":     "json",
+	".jsx":       "jsx",
+	".kt":        "kotlin",
+	".lua":       "lua",
+	".md":        "markdown",
+	".php":       "php",
+	".pl":        "perl",
+	".ps1":       "powershell",
+	".py":        "python",
+	".rb":        "ruby",
+	".rs":        "rust",
+	".sh":        "sh",
+	".sql":       "sql",
+	".swift":     "swift",
+	".toml":      "toml",
+	".ts":        "typescript",
+	".tsx":       "tsx",
+	".xml":       "xml",
+	".yaml":      "yaml",
+	".yml":       "yaml",
+	".zsh":       "zsh",
+	"Dockerfile": "dockerfile",
+	"Makefile":   "makefile",
+}
+
+// markdownLanguage returns the code fence language tag for p
+func markdownLanguage(p string) string {
+	base := path.Base(p)
+	if lang, ok := markdownLanguages[base]; ok {
+		return lang
+	}
+	ext := path.Ext(base)
+	if lang, ok := markdownLanguages[ext]; ok {
+		return lang
+	}
+	return strings.TrimPrefix(ext, ".")
+}
+
+// markdownFence returns a backtick fence longer than any backtick run in content
+func markdownFence(content string) string {
+	n := 3
+	for _, run := range reBacktickRun.FindAllString(content, -1) {
+		if len(run) >= n {
+			n = len(run) + 1
+		}
+	}
+	return strings.Repeat("`", n)
+}
+
+// markdownTreeWriter writes one "### path" heading and one fenced code block
+// per file, non-default perms are appended to the heading like
+// "### run.sh (0755)". Deletions are a "### path (deleted)" heading without a
+// block, renames are marked with "### path (renamed from old/path)" and
+// symlinks are a "### path (symlink to target)" heading without a block.
+// Binary files are base64 encoded and marked with "(base64)" at the end of the
+// heading, files that were cut short with "(truncated)" and files that don't
+// end with a newline with "(no final newline)", the block always does.
+type markdownTreeWriter struct {
+	w     io.Writer
+	count int
+}
+
+func (tw *markdownTreeWriter) Write(p string, entry Entry) error {
+	var buf bytes.Buffer
+	if tw.count > 0 {
+		buf.WriteString("\n")
+	}
+	tw.count++
+	buf.WriteString("### " + p)
+	switch {
+	case entry.Delete:
+		buf.WriteString(" (deleted)\n")
+	case entry.isSymlink():
+		buf.WriteString(" (symlink to " + entry.Target + ")\n")
+	default:
+		if entry.RenamedFrom != "" {
+			buf.WriteString(" (renamed from " + entry.RenamedFrom + ")")
+		}
+		if entry.Perm != "" && entry.Perm != defaultPerm {
+			buf.WriteString(" (" + entry.Perm + ")")
+		}
+		if entry.isBase64() {
+			buf.WriteString(" (base64)")
+		}
+		if entry.Truncated {
+			buf.WriteString(" (truncated)")
+		}
+		noEOL := entry.Content != "" && !strings.HasSuffix(entry.Content, "\n")
+		if noEOL {
+			buf.WriteString(" (no final newline)")
+		}
+		buf.WriteString("\n\n")
+
+		lang := markdownLanguage(p)
+		if entry.isBase64() {
+			lang = ""
+		}
+		fence := markdownFence(entry.Content)
+		buf.WriteString(fence + lang + "\n")
+		buf.WriteString(entry.Content)
+		if noEOL {
+			buf.WriteString("\n")
+		}
+		buf.WriteString(fence + "\n")
+	}
+	_, err := tw.w.Write(buf.Bytes())
+	return err
+}
+
+func (tw *markdownTreeWriter) Close() error {
+	return nil
+}
+
+// decodeMarkdown reads files from headings that are directly followed by a
+// code fence, any other text (prose around the blocks) is ignored
+func decodeMarkdown(data []byte) (map[string]Entry, error) {
+	tree, cut, err := decodeMarkdownPartial(data)
+	if err != nil {
+		return nil, err
+	}
+	if cut != "" {
+		return nil, fmt.Errorf("markdown: unterminated code block for %s", cut)
+	}
+	return tree, nil
+}
+
+// decodeMarkdownPartial is decodeMarkdown for input that may be cut off, it
+// stops at a code block that isn't closed and returns its path
+func decodeMarkdownPartial(data []byte) (map[string]Entry, string, error) {
+	tree := map[string]Entry{}
+
+	// only split on "\n", a "\r" belongs to the content of CRLF files
+	lines := strings.Split(string(data), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	for i := 0; i < len(lines); i++ {
+		m := reMarkdownHeading.FindStringSubmatch(lines[i])
+		if m == nil {
+			continue
+		}
+		heading := strings.TrimSpace(m[1])
+		if dm := reMarkdownDeleted.FindStringSubmatch(heading); dm != nil {
+			tree[strings.Trim(dm[1], "`")] = Entry{Delete: true}
+			continue
+		}
+		if sm := reMarkdownSymlink.FindStringSubmatch(heading); sm != nil {
+			tree[strings.Trim(sm[1], "`")] = Entry{Type: EntryTypeSymlink, Target: strings.Trim(sm[2], "`")}
+			continue
+		}
+		noEOL := false
+		if nm := reMarkdownNoEOL.FindStringSubmatch(heading); nm != nil {
+			heading = nm[1]
+			noEOL = true
+		}
+		truncated := false
+		if tm := reMarkdownTrunc.FindStringSubmatch(heading); tm != nil {
+			heading = tm[1]
+			truncated = true
+		}
+		encoding := ""
+		if bm := reMarkdownBase64.FindStringSubmatch(heading); bm != nil {
+			heading = bm[1]
+			encoding = EncodingBase64
+		}
+		p, perm := parseMarkdownHeading(heading)
+		renamedFrom := ""
+		if rm := reMarkdownRenamed.FindStringSubmatch(p); rm != nil {
+			p = strings.Trim(rm[1], "`")
+			renamedFrom = strings.Trim(rm[2], "`")
+		}
+
+		// the heading has to be followed by a fence, blank lines are fine
+		j := i + 1
+		for j < len(lines) && strings.TrimSpace(lines[j]) == "" {
+			j++
+		}
+		var fm []string
+		if j < len(lines) {
+			fm = reMarkdownFence.FindStringSubmatch(lines[j])
+		}
+		if fm == nil {
+			if renamedFrom != "" {
+				// renamed without changing the content
+				tree[p] = Entry{RenamedFrom: renamedFrom}
+			}
+			continue
+		}
+		fence := fm[1]
+
+		var content strings.Builder
+		closed := false
+		k := j + 1
+		for ; k < len(lines); k++ {
+			if isClosingFence(lines[k], fence) {
+				closed = true
+				break
+			}
+			content.WriteString(lines[k])
+			content.WriteString("\n")
+		}
+		if !closed {
+			return tree, p, nil
+		}
+
+		text := content.String()
+		if noEOL {
+			text = strings.TrimSuffix(text, "\n")
+		}
+		tree[p] = Entry{
+			Perm:        perm,
+			Encoding:    encoding,
+			Content:     text,
+			RenamedFrom: renamedFrom,
+			Truncated:   truncated,
+		}
+		i = k
+	}
+	return tree, "", nil
+}
+
+// parseMarkdownHeading splits "path (0755)" into path and perm
+func parseMarkdownHeading(heading string) (string, string) {
+	perm := "" // keeps the perm of existing files
+	if m := reMarkdownPerm.FindStringSubmatch(heading); m != nil {
+		heading = m[1]
+		perm = m[2]
+		if len(perm) == 3 {
+			perm = "0" + perm
+		}
+	}
+	return strings.Trim(heading, "`"), perm
+}
+
+// isClosingFence returns true if line closes a block opened with fence
+func isClosingFence(line string, fence string) bool {
+	line = strings.TrimRight(line, " \t\r")
+	if len(line) < len(fence) {
+		return false
+	}
+	return strings.Trim(line, fence[:1]) == ""
+}
+
+// looksLikeMarkdownTree returns true if data contains a heading followed by a
+// code fence, or a deletion/rename/symlink heading
+func looksLikeMarkdownTree(data []byte) bool {
+	return reMarkdownTree.Match(data)
+}
@@ -0,0 +1,40 @@
+package filetree
+
+import (
+	"reflect"
+	"testing"
+)
+
+// The Markdown format has to give back the exact bytes that went in
+func TestMarkdownRoundTrip(t *testing.T) {
+	tree := map[string]Entry{
+		"crlf.txt":        {Content: "one\r\ntwo\r\n"},
+		"crlf-noeol.txt":  {Content: "one\r\ntwo"},
+		"cr.txt":          {Content: "a\r"},
+		"noeol.txt":       {Content: "no newline"},
+		"blank-end.txt":   {Content: "two newlines\n\n"},
+		"newline.txt":     {Content: "\n"},
+		"empty.txt":       {Content: ""},
+		"fence.md":        {Content: "```go\nx := 1\n```\n~~~\n"},
+		"run.sh":          {Perm: "0755", Content: "#!/bin/sh\necho hi\n"},
+		"bin.dat":         {Encoding: "base64", Content: "AAEC"},
+		"sub/heading.txt": {Content: "### not/a/file.txt\n"},
+		"trunc.txt":       {Truncated: true, Content: "cut"},
+	}
+	data, err := encodeTree(tree, FormatMD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := decodeTree(data, FormatMD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, tree) {
+		for p, want := range tree {
+			if got[p] != want {
+				t.Errorf("%s: got %#v, want %#v", p, got[p], want)
+			}
+		}
+		t.Fatalf("round trip changed the tree:\n%s", data)
+	}
+}
@@ -0,0 +1,125 @@
+package filetree
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+const (
+	ConflictRefuse    = "refuse"
+	ConflictMerge     = "merge"
+	ConflictOverwrite = "overwrite"
+)
+
+var (
+	// OnConflict decides what expand does with files that changed on disk
+	// since they were flattened
+	OnConflict string = ConflictRefuse
+
+	// BasePath is the snapshot that was flattened, it's the merge base
+	BasePath string = ""
+)
+
+// contentHash is the hash flatten records in Entry.Hash
+func contentHash(content string) string {
+	return fmt.Sprintf("%016x", xxhash.Sum64String(content))
+}
+
+// matchedLines maps every line of a to the line of b it's equal to in the
+// shortest edit script, or -1
+func matchedLines(a, b []string) []int {
+	matches := make([]int, len(a))
+	i, j := 0, 0
+	for _, op := range diffLines(a, b) {
+		switch op.Kind {
+		case ' ':
+			matches[i] = j
+			i++
+			j++
+		case '-':
+			matches[i] = -1
+			i++
+		case '+':
+			j++
+		}
+	}
+	return matches
+}
+
+// merge3 merges the changes from base to ours and from base to theirs line by
+// line, overlapping changes become conflict blocks. It returns the merged text
+// and the number of conflicts.
+func merge3(base, ours, theirs string) (string, int) {
+	baseLines := splitLines(base)
+	ourLines := splitLines(ours)
+	theirLines := splitLines(theirs)
+
+	ourMatches := matchedLines(baseLines, ourLines)
+	theirMatches := matchedLines(baseLines, theirLines)
+
+	var out strings.Builder
+	conflicts := 0
+
+	// resolve the chunks between lines that are unchanged on both sides
+	resolve := func(b, o, t []string) {
+		switch {
+		case equalLines(o, b):
+			writeLines(&out, t)
+		case equalLines(t, b), equalLines(o, t):
+			writeLines(&out, o)
+		default:
+			conflicts++
+			out.WriteString("<<<<<<< ours (on disk)\n")
+			writeLines(&out, o)
+			terminateLine(&out)
+			out.WriteString("||||||| base (flattened)\n")
+			writeLines(&out, b)
+			terminateLine(&out)
+			out.WriteString("=======\n")
+			writeLines(&out, t)
+			terminateLine(&out)
+			out.WriteString(">>>>>>> theirs (expanded)\n")
+		}
+	}
+
+	i, o, t := 0, 0, 0
+	for k := 0; k < len(baseLines); k++ {
+		if ourMatches[k] < 0 || theirMatches[k] < 0 {
+			continue
+		}
+		resolve(baseLines[i:k], ourLines[o:ourMatches[k]], theirLines[t:theirMatches[k]])
+		out.WriteString(baseLines[k])
+		i, o, t = k+1, ourMatches[k]+1, theirMatches[k]+1
+	}
+	resolve(baseLines[i:], ourLines[o:], theirLines[t:])
+
+	return out.String(), conflicts
+}
+
+func equalLines(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func writeLines(out *strings.Builder, lines []string) {
+	for _, line := range lines {
+		out.WriteString(line)
+	}
+}
+
+// terminateLine makes sure a conflict marker starts on a new line
+func terminateLine(out *strings.Builder) {
+	s := out.String()
+	if s != "" && !strings.HasSuffix(s, "\n") {
+		out.WriteString("\n")
+	}
+}
@@ -0,0 +1,141 @@
+package filetree
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mrvnmyr/oat/common"
+)
+
+var (
+	// Metadata makes flatten record the size and mtime of every file
+	Metadata bool = false
+
+	// PreserveTimes makes expand restore the recorded mtimes
+	PreserveTimes bool = false
+)
+
+// ErrDrift is returned by verify if the directory doesn't match the snapshot
+var ErrDrift = errors.New("the directory doesn't match the snapshot")
+
+func formatMTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+func parseMTime(s string) (time.Time, error) {
+	return time.Parse(time.RFC3339Nano, s)
+}
+
+// VerifyTree compares the snapshot at yamlPath with the files below root and
+// prints every file that differs, it returns ErrDrift if any do. Files that
+// aren't in the snapshot are not reported.
+func VerifyTree(yamlPath, root string) error {
+	data, err := common.ReadFileOrStdin(yamlPath)
+	if err != nil {
+		return err
+	}
+	tree, err := decodeTree(data, InputFormat)
+	if err != nil {
+		return err
+	}
+
+	checked, drifted := 0, 0
+	for _, p := range sortedPaths(tree) {
+		entry := tree[p]
+		if entry.Delete || entry.RenamedFrom != "" {
+			continue // changes, not part of a snapshot
+		}
+		checked++
+		problems, err := verifyEntry(root, p, entry)
+		if err != nil {
+			return err
+		}
+		if len(problems) > 0 {
+			drifted++
+			fmt.Printf("%s: %s\n", p, strings.Join(problems, ", "))
+		}
+	}
+	if drifted > 0 {
+		fmt.Fprintf(os.Stderr, "%d of %d files drifted\n", drifted, checked)
+		return ErrDrift
+	}
+	return nil
+}
+
+// verifyEntry lists how the file p below root differs from entry
+func verifyEntry(root string, p string, entry Entry) ([]string, error) {
+	full := filepath.FromSlash(p)
+	if !filepath.IsAbs(full) {
+		full = filepath.Join(root, full)
+	}
+	info, err := os.Lstat(full)
+	if os.IsNotExist(err) {
+		return []string{"missing"}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if entry.isSymlink() {
+		if info.Mode()&os.ModeSymlink == 0 {
+			return []string{"not a symlink"}, nil
+		}
+		target, err := os.Readlink(full)
+		if err != nil {
+			return nil, err
+		}
+		if filepath.ToSlash(target) != entry.Target {
+			return []string{fmt.Sprintf("target %s, expected %s", filepath.ToSlash(target), entry.Target)}, nil
+		}
+		return nil, nil
+	}
+	if !info.Mode().IsRegular() {
+		return []string{"not a regular file"}, nil
+	}
+
+	var problems []string
+	if entry.Perm != "" {
+		perm, err := parsePerm(entry.Perm)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid perm %q: %w", p, entry.Perm, err)
+		}
+		if info.Mode().Perm() != perm.Perm() {
+			problems = append(problems, fmt.Sprintf("perm %04o, expected %s", info.Mode().Perm(), entry.Perm))
+		}
+	}
+	if entry.Size != 0 && info.Size() != entry.Size {
+		problems = append(problems, fmt.Sprintf("size %d, expected %d", info.Size(), entry.Size))
+	}
+	if entry.MTime != "" {
+		mtime, err := parseMTime(entry.MTime)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid mtime %q: %w", p, entry.MTime, err)
+		}
+		if !info.ModTime().Equal(mtime) {
+			problems = append(problems, fmt.Sprintf("mtime %s, expected %s", formatMTime(info.ModTime()), entry.MTime))
+		}
+	}
+
+	b, err := os.ReadFile(full)
+	if err != nil {
+		return nil, err
+	}
+	if entry.Hash != "" {
+		if hash := contentHash(string(b)); hash != entry.Hash {
+			problems = append(problems, fmt.Sprintf("hash %s, expected %s", hash, entry.Hash))
+		}
+	} else if !entry.Truncated {
+		content, err := entry.decodedContent()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", p, err)
+		}
+		if string(b) != content {
+			problems = append(problems, "content differs")
+		}
+	}
+	return problems, nil
+}
@@ -0,0 +1,576 @@
+package filetree
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/mrvnmyr/oat/common"
+)
+
+// Fuzz is how many context lines at the start and end of a hunk may be
+// ignored when it doesn't match otherwise, like patch --fuzz
+var Fuzz int = 2
+
+// Partial writes the hunks of a file that apply even if others of it fail,
+// otherwise such a file is left as it is
+var Partial bool = false
+
+// ErrPatchFailed is returned by apply if some hunks or blocks didn't apply
+var ErrPatchFailed = errors.New("some hunks failed to apply")
+
+var reHunkHeader = regexp.MustCompile(`^@@ -(\d+)(?:,\d+)? \+\d+(?:,\d+)? @@`)
+
+// patchHunk is one @@ block of a unified diff
+type patchHunk struct {
+	OldStart int      // line number from the header, 0 if there is none
+	Lines    []string // with their ' ', '-' or '+' prefix
+	OldNoNL  bool     // the old side ends without a newline
+	NewNoNL  bool     // the new side ends without a newline
+}
+
+// searchReplace is a SEARCH/REPLACE block
+type searchReplace struct {
+	Search  string
+	Replace string
+}
+
+// filePatch is everything a diff or SEARCH/REPLACE block does to one file
+type filePatch struct {
+	OldPath string // "" for new files
+	NewPath string // "" for deleted files
+	Perm    string // from a git "new file mode" or "new mode" line
+	Binary  bool   // a binary diff, those can't be applied
+
+	Hunks  []patchHunk
+	Blocks []searchReplace
+}
+
+// path returns the path the patch writes to
+func (fp filePatch) path() string {
+	if fp.NewPath != "" {
+		return fp.NewPath
+	}
+	return fp.OldPath
+}
+
+// parsePatches finds unified diffs, git diffs and SEARCH/REPLACE blocks in
+// text, anything around them (prose, code fences) is ignored
+func parsePatches(text string) ([]filePatch, error) {
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+
+	var patches []filePatch
+	lastFile := ""
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		switch {
+		case strings.TrimSpace(line) == "<<<<<<< SEARCH":
+			file := searchReplaceFile(lines, i)
+			if file == "" {
+				file = lastFile
+			}
+			if file == "" {
+				return nil, fmt.Errorf("line %d: SEARCH block without a file name", i+1)
+			}
+			block, next, err := parseSearchReplace(lines, i)
+			if err != nil {
+				return nil, err
+			}
+			if n := len(patches); n > 0 && patches[n-1].Blocks != nil && patches[n-1].NewPath == file {
+				patches[n-1].Blocks = append(patches[n-1].Blocks, block)
+			} else {
+				patches = append(patches, filePatch{OldPath: file, NewPath: file, Blocks: []searchReplace{block}})
+			}
+			lastFile = file
+			i = next
+		case strings.HasPrefix(line, "diff --git "):
+			fp, next := parseGitDiff(lines, i)
+			patches = append(patches, fp)
+			i = next
+		case isFileHeader(lines, i):
+			fp := filePatch{}
+			fp.OldPath, fp.NewPath = diffPaths(lines[i], lines[i+1])
+			fp.Hunks, i = parseHunks(lines, i+2)
+			patches = append(patches, fp)
+		default:
+			i++
+		}
+	}
+	return patches, nil
+}
+
+// isFileHeader returns true if lines[i] and lines[i+1] are "--- old" and
+// "+++ new"
+func isFileHeader(lines []string, i int) bool {
+	return i+1 < len(lines) && strings.HasPrefix(lines[i], "--- ") && strings.HasPrefix(lines[i+1], "+++ ")
+}
+
+// diffPaths returns the paths of "--- a/old" and "+++ b/new" lines, "" for
+// /dev/null
+func diffPaths(oldLine, newLine string) (string, string) {
+	name := func(line string) string {
+		name := strings.TrimSpace(line[4:])
+		if tab := strings.IndexByte(name, '\t'); tab >= 0 {
+			name = name[:tab] // a timestamp
+		}
+		if name == "/dev/null" {
+			return ""
+		}
+		return strings.Trim(name, `"`)
+	}
+	oldPath, newPath := name(oldLine), name(newLine)
+
+	// git prefixes the paths with a/ and b/
+	if (oldPath == "" || strings.HasPrefix(oldPath, "a/")) && (newPath == "" || strings.HasPrefix(newPath, "b/")) {
+		oldPath = strings.TrimPrefix(oldPath, "a/")
+		newPath = strings.TrimPrefix(newPath, "b/")
+	}
+	return oldPath, newPath
+}
+
+// parseGitDiff reads a "diff --git" header, its extended header lines and
+// hunks
+func parseGitDiff(lines []string, i int) (filePatch, int) {
+	fp := filePatch{}
+	header := strings.TrimPrefix(lines[i], "diff --git ")
+	if strings.HasPrefix(header, "a/") {
+		if b := strings.LastIndex(header, " b/"); b >= 0 {
+			fp.OldPath, fp.NewPath = header[2:b], header[b+3:]
+		}
+	}
+
+	i++
+	for ; i < len(lines); i++ {
+		line := lines[i]
+		switch {
+		case strings.HasPrefix(line, "new file mode "):
+			fp.OldPath = ""
+			fp.Perm = gitModePerm(strings.TrimPrefix(line, "new file mode "))
+		case strings.HasPrefix(line, "deleted file mode "):
+			fp.NewPath = ""
+		case strings.HasPrefix(line, "new mode "):
+			fp.Perm = gitModePerm(strings.TrimPrefix(line, "new mode "))
+		case strings.HasPrefix(line, "rename from "):
+			fp.OldPath = strings.TrimPrefix(line, "rename from ")
+		case strings.HasPrefix(line, "rename to "):
+			fp.NewPath = strings.TrimPrefix(line, "rename to ")
+		case strings.HasPrefix(line, "Binary files "), line == "GIT binary patch":
+			fp.Binary = true
+		case strings.HasPrefix(line, "old mode "), strings.HasPrefix(line, "index "),
+			strings.HasPrefix(line, "similarity index "), strings.HasPrefix(line, "dissimilarity index "):
+		case isFileHeader(lines, i):
+			fp.OldPath, fp.NewPath = diffPaths(lines[i], lines[i+1])
+			fp.Hunks, i = parseHunks(lines, i+2)
+			return fp, i
+		default:
+			return fp, i
+		}
+	}
+	return fp, i
+}
+
+// gitModePerm turns a git mode like "100755" into a perm like "0755"
+func gitModePerm(mode string) string {
+	mode = strings.TrimSpace(mode)
+	if len(mode) != 6 || !strings.HasPrefix(mode, "100") {
+		return ""
+	}
+	return "0" + mode[3:]
+}
+
+// isHunkLine returns true for the lines a hunk body consists of
+func isHunkLine(line string) bool {
+	return line != "" && strings.ContainsRune(" -+\\", rune(line[0]))
+}
+
+// parseHunks reads the hunks starting at lines[i]. The line counts in the
+// headers are ignored since models often get them wrong, a hunk ends at the
+// first line that can't be part of it.
+func parseHunks(lines []string, i int) ([]patchHunk, int) {
+	var hunks []patchHunk
+	for i < len(lines) && strings.HasPrefix(lines[i], "@@") {
+		h := patchHunk{}
+		if m := reHunkHeader.FindStringSubmatch(lines[i]); m != nil {
+			h.OldStart, _ = strconv.Atoi(m[1])
+		}
+		i++
+		for ; i < len(lines); i++ {
+			line := lines[i]
+			if isFileHeader(lines, i) {
+				break
+			}
+			if line == "" {
+				// an empty context line that lost its space, if the hunk goes on
+				j := i + 1
+				for j < len(lines) && lines[j] == "" {
+					j++
+				}
+				if j < len(lines) && isHunkLine(lines[j]) && !isFileHeader(lines, j) {
+					h.Lines = append(h.Lines, " ")
+					continue
+				}
+				break
+			}
+			if !isHunkLine(line) {
+				break
+			}
+			if line[0] == '\\' {
+				if len(h.Lines) > 0 {
+					switch h.Lines[len(h.Lines)-1][0] {
+					case ' ':
+						h.OldNoNL, h.NewNoNL = true, true
+					case '-':
+						h.OldNoNL = true
+					case '+':
+						h.NewNoNL = true
+					}
+				}
+				continue
+			}
+			h.Lines = append(h.Lines, line)
+		}
+		hunks = append(hunks, h)
+	}
+	return hunks, i
+}
+
+// searchReplaceFile returns the file name in front of the SEARCH marker at
+// lines[i], skipping blank lines and code fences
+func searchReplaceFile(lines []string, i int) string {
+	for j := i - 1; j >= 0; j-- {
+		line := strings.TrimSpace(lines[j])
+		if line == "" || strings.HasPrefix(line, "```") || strings.HasPrefix(line, "~~~") {
+			continue
+		}
+		if line == ">>>>>>> REPLACE" {
+			return "" // another block for the same file
+		}
+		line = strings.TrimLeft(line, "#*> ")
+		line = strings.TrimPrefix(line, "File:")
+		line = strings.TrimPrefix(line, "file:")
+		return strings.Trim(strings.TrimSpace(line), "`*:")
+	}
+	return ""
+}
+
+// parseSearchReplace reads the SEARCH/REPLACE block starting at lines[i]
+func parseSearchReplace(lines []string, i int) (searchReplace, int, error) {
+	start := i
+	var search, replace []string
+	i++
+	for ; i < len(lines) && strings.TrimSpace(lines[i]) != "======="; i++ {
+		search = append(search, lines[i])
+	}
+	if i == len(lines) {
+		return searchReplace{}, i, fmt.Errorf("line %d: SEARCH block without =======", start+1)
+	}
+	i++
+	for ; i < len(lines) && strings.TrimSpace(lines[i]) != ">>>>>>> REPLACE"; i++ {
+		replace = append(replace, lines[i])
+	}
+	if i == len(lines) {
+		return searchReplace{}, i, fmt.Errorf("line %d: SEARCH block without >>>>>>> REPLACE", start+1)
+	}
+	block := searchReplace{}
+	if len(search) > 0 {
+		block.Search = strings.Join(search, "\n") + "\n"
+	}
+	if len(replace) > 0 {
+		block.Replace = strings.Join(replace, "\n") + "\n"
+	}
+	return block, i + 1, nil
+}
+
+// fileLines splits content into lines without their newlines
+func fileLines(content string) ([]string, bool) {
+	if content == "" {
+		return nil, true
+	}
+	finalNL := strings.HasSuffix(content, "\n")
+	return strings.Split(strings.TrimSuffix(content, "\n"), "\n"), finalNL
+}
+
+// joinLines is the inverse of fileLines
+func joinLines(lines []string, finalNL bool) string {
+	if len(lines) == 0 {
+		return ""
+	}
+	content := strings.Join(lines, "\n")
+	if finalNL {
+		content += "\n"
+	}
+	return content
+}
+
+// normalizeSpace collapses all whitespace for the fuzzy comparisons
+func normalizeSpace(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// findLines returns where old occurs in lines at or after from, the match
+// closest to want wins. It returns -1 if there is none.
+func findLines(lines []string, old []string, from int, want int, fuzzy bool) int {
+	best := -1
+	for pos := from; pos+len(old) <= len(lines); pos++ {
+		match := true
+		for k := range old {
+			a, b := lines[pos+k], old[k]
+			if a != b && (!fuzzy || normalizeSpace(a) != normalizeSpace(b)) {
+				match = false
+				break
+			}
+		}
+		if !match {
+			continue
+		}
+		if best < 0 || abs(pos-want) < abs(best-want) {
+			best = pos
+		}
+		if pos >= want {
+			break // later matches are further away
+		}
+	}
+	return best
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// applyHunks applies hunks to content in order, the hunks that don't match are
+// skipped. It returns the new content and one report line per hunk.
+func applyHunks(content string, hunks []patchHunk) (string, []string, int) {
+	lines, finalNL := fileLines(content)
+	var reports []string
+	failed := 0
+	from, growth := 0, 0
+
+	for n, h := range hunks {
+		applied := false
+		for fuzz := 0; fuzz <= Fuzz && !applied; fuzz++ {
+			lead, body := trimContext(h.Lines, fuzz)
+			if fuzz > 0 && len(body) == len(h.Lines) {
+				break // no context left to ignore
+			}
+
+			var old []string
+			for _, line := range body {
+				if line[0] != '+' {
+					old = append(old, line[1:])
+				}
+			}
+			if fuzz > 0 && len(old) == 0 {
+				break // nothing left to match
+			}
+			want := max(h.OldStart-1, 0) + lead + growth
+			if len(old) == 0 && h.OldStart > 0 {
+				want = h.OldStart + growth // a pure insertion goes after the old start line
+			}
+			want = min(max(want, from), len(lines))
+
+			for _, fuzzy := range []bool{false, true} {
+				pos := want
+				if len(old) > 0 {
+					pos = findLines(lines, old, from, want, fuzzy)
+				}
+				if pos < 0 {
+					continue
+				}
+
+				var replacement []string
+				k := pos
+				for _, line := range body {
+					switch line[0] {
+					case ' ':
+						replacement = append(replacement, lines[k]) // keep what's on disk
+						k++
+					case '-':
+						k++
+					case '+':
+						replacement = append(replacement, line[1:])
+					}
+				}
+				atEnd := k == len(lines)
+				lines = append(lines[:pos], append(replacement, lines[k:]...)...)
+				if atEnd && (h.NewNoNL || h.OldNoNL) {
+					finalNL = !h.NewNoNL
+				}
+
+				report := fmt.Sprintf("hunk %d applied at line %d", n+1, pos+1)
+				var notes []string
+				if h.OldStart > 0 && pos != want {
+					notes = append(notes, fmt.Sprintf("offset %d lines", pos-want))
+				}
+				if fuzz > 0 {
+					notes = append(notes, fmt.Sprintf("fuzz %d", fuzz))
+				}
+				if fuzzy {
+					notes = append(notes, "ignoring whitespace")
+				}
+				if len(notes) > 0 {
+					report += " (" + strings.Join(notes, ", ") + ")"
+				}
+				reports = append(reports, report)
+
+				from = pos + len(replacement)
+				growth += len(replacement) - (k - pos)
+				applied = true
+				break
+			}
+		}
+		if !applied {
+			failed++
+			reports = append(reports, fmt.Sprintf("hunk %d FAILED", n+1))
+		}
+	}
+	return joinLines(lines, finalNL), reports, failed
+}
+
+// trimContext drops up to fuzz context lines from the start and end of a
+// hunk body, it also returns how many were dropped from the start
+func trimContext(body []string, fuzz int) (int, []string) {
+	start, end := 0, len(body)
+	for k := 0; k < fuzz && start < end && body[start][0] == ' '; k++ {
+		start++
+	}
+	for k := 0; k < fuzz && end > start && body[end-1][0] == ' '; k++ {
+		end--
+	}
+	return start, body[start:end]
+}
+
+// applyBlocks applies SEARCH/REPLACE blocks to content in order. An empty
+// SEARCH appends to the file (or creates it).
+func applyBlocks(content string, blocks []searchReplace) (string, []string, int) {
+	var reports []string
+	failed := 0
+	for n, b := range blocks {
+		switch {
+		case b.Search == "":
+			content += b.Replace
+			reports = append(reports, fmt.Sprintf("block %d appended", n+1))
+		case strings.Contains(content, b.Search):
+			content = strings.Replace(content, b.Search, b.Replace, 1)
+			reports = append(reports, fmt.Sprintf("block %d applied", n+1))
+		default:
+			lines, finalNL := fileLines(content)
+			search, _ := fileLines(b.Search)
+			replace, _ := fileLines(b.Replace)
+			pos := findLines(lines, search, 0, 0, true)
+			if pos < 0 {
+				failed++
+				reports = append(reports, fmt.Sprintf("block %d FAILED", n+1))
+				continue
+			}
+			lines = append(lines[:pos], append(replace, lines[pos+len(search):]...)...)
+			content = joinLines(lines, finalNL)
+			reports = append(reports, fmt.Sprintf("block %d applied at line %d (ignoring whitespace)", n+1, pos+1))
+		}
+	}
+	return content, reports, failed
+}
+
+// ApplyPatch applies the diffs and SEARCH/REPLACE blocks in patchPath (which
+// may be a whole model reply) to the files below destRoot. The results go
+// through expand, so --dry-run, --interactive and the output root checks
+// work the same. A file with hunks that fail is left unchanged unless
+// Partial, either way ErrPatchFailed is returned, with --dry-run too.
+func ApplyPatch(patchPath, destRoot string) error {
+	data, err := common.ReadFileOrStdin(patchPath)
+	if err != nil {
+		return err
+	}
+	patches, err := parsePatches(string(data))
+	if err != nil {
+		return err
+	}
+	if len(patches) == 0 {
+		return fmt.Errorf("no diffs or SEARCH/REPLACE blocks found in %s", patchPath)
+	}
+
+	tree := map[string]Entry{}
+	contents := map[string]string{} // of files patched before
+	failedFiles := map[string]int{} // path -> failed hunks and blocks
+	for _, fp := range patches {
+		p := fp.path()
+		if fp.Binary {
+			fmt.Fprintf(os.Stderr, "%s: binary diffs are not supported\n", p)
+			failedFiles[p]++
+			continue
+		}
+		if fp.NewPath == "" {
+			tree[fp.OldPath] = Entry{Delete: true}
+			fmt.Fprintf(os.Stderr, "%s: deleted\n", fp.OldPath)
+			continue
+		}
+
+		entry := tree[p]
+		entry.Delete = false
+		if fp.Perm != "" {
+			entry.Perm = fp.Perm
+		}
+		if fp.OldPath != "" && fp.OldPath != fp.NewPath {
+			entry.RenamedFrom = fp.OldPath
+		}
+
+		source := fp.OldPath
+		if _, ok := contents[p]; ok || source == "" {
+			source = p
+		}
+		content, ok := contents[source]
+		if !ok && fp.OldPath != "" {
+			full, err := resolveDest(destRoot, source)
+			if err != nil {
+				return err
+			}
+			b, err := os.ReadFile(full)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			content = string(b)
+		}
+
+		var reports []string
+		var n int
+		if fp.Blocks != nil {
+			content, reports, n = applyBlocks(content, fp.Blocks)
+		} else {
+			content, reports, n = applyHunks(content, fp.Hunks)
+		}
+		if n > 0 {
+			failedFiles[p] += n
+		}
+		for _, r := range reports {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", p, r)
+		}
+
+		entry.Content = content
+		tree[p] = entry
+		contents[p] = content
+	}
+
+	failed := 0
+	for _, p := range slices.Sorted(maps.Keys(failedFiles)) {
+		failed += failedFiles[p]
+		if Partial {
+			fmt.Fprintf(os.Stderr, "%s: %d failed, writing the rest\n", p, failedFiles[p])
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "%s: %d failed, leaving it unchanged (see --partial)\n", p, failedFiles[p])
+		delete(tree, p)
+	}
+
+	err = expandTree(tree, destRoot, patchPath, nil)
+	if failed > 0 && (err == nil || errors.Is(err, ErrChangesPending)) {
+		return fmt.Errorf("%w: %d failed in %d files", ErrPatchFailed, failed, len(failedFiles))
+	}
+	return err
+}
@@ -0,0 +1,71 @@
+package filetree
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testPatch = `--- a/a.txt
++++ b/a.txt
+@@ -1,3 +1,3 @@
+ one
+-two
++TWO
+ three
+@@ -5,3 +5,3 @@
+ five
+-not there
++SIX
+ seven
+--- a/b.txt
++++ b/b.txt
+@@ -1,2 +1,2 @@
+-b
++B
+ end
+`
+
+// A file with a failed hunk is left alone unless --partial, the others are
+// patched and apply fails in every mode
+func TestApplyPatchFailedHunks(t *testing.T) {
+	files := map[string]string{
+		"a.txt": "one\ntwo\nthree\nfour\nfive\nsix\nseven\n",
+		"b.txt": "b\nend\n",
+	}
+	for _, c := range []struct {
+		name            string
+		dryRun, partial bool
+		want            map[string]string
+	}{
+		{"all-or-nothing", false, false, map[string]string{"a.txt": files["a.txt"], "b.txt": "B\nend\n"}},
+		{"partial", false, true, map[string]string{"a.txt": "one\nTWO\nthree\nfour\nfive\nsix\nseven\n", "b.txt": "B\nend\n"}},
+		{"dry-run", true, false, files},
+		{"dry-run partial", true, true, files},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			defer keep(&DryRun)()
+			defer keep(&Partial)()
+			DryRun, Partial = c.dryRun, c.partial
+
+			dir := t.TempDir()
+			writeTestFiles(t, dir, files)
+			patch := filepath.Join(t.TempDir(), "patch.diff")
+			writeTestFiles(t, filepath.Dir(patch), map[string]string{"patch.diff": testPatch})
+
+			if err := ApplyPatch(patch, dir); !errors.Is(err, ErrPatchFailed) {
+				t.Errorf("got %v, want ErrPatchFailed", err)
+			}
+			for p, want := range c.want {
+				got, err := os.ReadFile(filepath.Join(dir, p))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(got) != want {
+					t.Errorf("%s: got %q, want %q", p, got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,176 @@
+package filetree
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/mrvnmyr/oat/common"
+)
+
+// promptFileName is the template looked up next to .flattenignore/.flattenallow
+const promptFileName = ".flattenprompt"
+
+var (
+	// Prompt is the task that is put into the LLM prompt
+	Prompt string = ""
+
+	// PromptFile is read into Prompt if set
+	PromptFile string = ""
+
+	// TemplateFile is a text/template that renders the LLM prompt
+	TemplateFile string = ""
+)
+
+const defaultPromptTemplate = `{{.FencedTree}}
+This is a flattened filetree represented as a {{.FormatName}}.
+
+{{if .Task}}{{.Task}}{{else}}TODO{{end}}
+
+Implement what is required to fix this issue and output it in the same flattened filetree {{.FormatName}} structure as was provided before.{{if .HasHashes}} Keep the hash of every file as it is.{{end}}{{if .HasBinaries}} Binary files are base64 encoded, don't output them unless you replace them.{{end}}{{if .HasTruncated}} Files marked as truncated are incomplete, never output them.{{end}}{{if .HasRedactions}} Secrets were replaced with [REDACTED:...] placeholders, keep them as they are.{{end}}
+
+If files are not changed don't output them.
+{{if eq .Format "md"}}
+To delete a file output only its heading with " (deleted)" appended. To move a file append " (renamed from <old path>)" to the heading of its new path, the code block can be left out if the content doesn't change.
+{{else}}
+To delete a file output it with "delete: true" and no content. To move a file output it under its new path with "renamed_from: <old path>", the content can be left out if it doesn't change.
+{{end}}`
+
+// PromptStats are totals over all flattened files
+type PromptStats struct {
+	Files  int
+	Bytes  int
+	Lines  int
+	Tokens int // estimated by --tokenizer
+}
+
+// PromptData is passed to the prompt template
+type PromptData struct {
+	Tree          string   // the tree in its output format
+	FencedTree    string   // Tree wrapped in a code fence (as is for md)
+	Format        string   // e.g. "yaml"
+	FormatName    string   // e.g. "YAML"
+	Files         []string // sorted paths of all files
+	Stats         PromptStats
+	Task          string // --prompt or the contents of --prompt-file
+	HasHashes     bool   // the entries carry hashes the model has to keep
+	HasBinaries   bool   // some entries are base64 encoded
+	HasTruncated  bool   // some entries were cut short by --max-file-size
+	HasRedactions bool   // some secrets were replaced with placeholders
+}
+
+// wantsPrompt returns true if any flag asks for LLM prompt output
+func wantsPrompt() bool {
+	return LLM || Prompt != "" || PromptFile != "" || TemplateFile != ""
+}
+
+// loadTask returns the user's task from --prompt or --prompt-file
+func loadTask() (string, error) {
+	if Prompt != "" && PromptFile != "" {
+		return "", fmt.Errorf("use either --prompt or --prompt-file, not both")
+	}
+	if PromptFile != "" {
+		b, err := common.ReadFileOrStdin(common.ExpandHome(PromptFile))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(b)), nil
+	}
+	return strings.TrimSpace(Prompt), nil
+}
+
+// loadPromptTemplate returns --template, the .flattenprompt found in
+// templateDir, or the default template, in that order
+func loadPromptTemplate(templateDir string) (*template.Template, error) {
+	text := defaultPromptTemplate
+	name := "default"
+
+	if TemplateFile != "" {
+		name = common.ExpandHome(TemplateFile)
+		b, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		text = string(b)
+	} else if templateDir != "" {
+		candidate := filepath.Join(templateDir, promptFileName)
+		b, err := os.ReadFile(candidate)
+		if err == nil {
+			common.Debugf("Using prompt template %s\n", candidate)
+			name = candidate
+			text = string(b)
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	return template.New(name).Option("missingkey=error").Parse(text)
+}
+
+// formatName returns the human readable name of format
+func formatName(format string) string {
+	if format == FormatMD {
+		return "Markdown"
+	}
+	return strings.ToUpper(format)
+}
+
+// renderPrompt renders the prompt template around the already encoded tree
+func renderPrompt(tree map[string]Entry, out []byte, templateDir string) ([]byte, error) {
+	task, err := loadTask()
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := loadPromptTemplate(templateDir)
+	if err != nil {
+		return nil, err
+	}
+
+	data := PromptData{
+		Tree:       string(out),
+		Format:     OutputFormat,
+		FormatName: formatName(OutputFormat),
+		Files:      sortedPaths(tree),
+		Task:       task,
+		HasHashes:  !NoHash && OutputFormat != FormatMD,
+	}
+	if OutputFormat == FormatMD {
+		// every file already is in its own code block
+		data.FencedTree = data.Tree
+	} else {
+		fence := markdownFence(data.Tree)
+		data.FencedTree = fence + OutputFormat + "\n" + data.Tree + fence + "\n"
+	}
+	for _, entry := range tree {
+		if entry.isBase64() {
+			data.HasBinaries = true
+		}
+		if entry.Truncated {
+			data.HasTruncated = true
+		}
+		if rePlaceholder.MatchString(entry.Content) {
+			data.HasRedactions = true
+		}
+		data.Stats.Files++
+		data.Stats.Bytes += len(entry.Content)
+		data.Stats.Lines += strings.Count(entry.Content, "\n")
+		if entry.Content != "" && !strings.HasSuffix(entry.Content, "\n") {
+			data.Stats.Lines++
+		}
+	}
+
+	t, err := currentTokenizer()
+	if err != nil {
+		return nil, err
+	}
+	data.Stats.Tokens = treeTokens(t, tree)
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,304 @@
+package filetree
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// redactFileName holds custom redaction regexes, it's looked up in the working
+// directory and its parents
+const redactFileName = ".flattenredact"
+
+var (
+	// Redact masks secrets even if the output isn't an LLM prompt
+	Redact bool = false
+
+	// NoRedact disables masking secrets in LLM prompts
+	NoRedact bool = false
+)
+
+// rePlaceholder matches the tokens secrets are replaced with
+var rePlaceholder = regexp.MustCompile(`\[REDACTED:([a-z0-9-]+):(\d+)\]`)
+
+// redactRule is a detector, if rx has a group only the first group is masked
+type redactRule struct {
+	Name        string
+	Source      string // "built-in" or the .flattenredact it comes from
+	Line        int
+	rx          *regexp.Regexp
+	check       func(match string) bool // optional, filters the matches of rx
+	noChecksums bool                    // not used for checksumFiles
+}
+
+// checksumFiles are lockfiles and checksum lists (matched by their base name),
+// their hashes look random but aren't secrets
+var checksumFiles = []string{
+	"go.sum", "go.work.sum", "package-lock.json", "npm-shrinkwrap.json", "yarn.lock", "pnpm-lock.yaml",
+	"bun.lock", "Cargo.lock", "Gemfile.lock", "composer.lock", "poetry.lock", "Pipfile.lock", "uv.lock",
+	"pdm.lock", "flake.lock", "mix.lock", "pubspec.lock", "Package.resolved", "gradle.lockfile",
+	"*SUMS", "*.sha1", "*.sha256", "*.sha512", "*.md5",
+}
+
+// isChecksumFile returns true if p is one of the checksumFiles
+func isChecksumFile(p string) bool {
+	for _, glob := range checksumFiles {
+		if ok, _ := path.Match(glob, path.Base(p)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// redactRulesFor returns the rules used for the file p, flatten and expand
+// have to use the same ones or the placeholders wouldn't match
+func redactRulesFor(p string, rules []redactRule) []redactRule {
+	if !isChecksumFile(p) {
+		return rules
+	}
+	var filtered []redactRule
+	for _, rule := range rules {
+		if !rule.noChecksums {
+			filtered = append(filtered, rule)
+		}
+	}
+	return filtered
+}
+
+var builtinRedactRules = []redactRule{
+	{
+		Name: "private-key",
+		rx:   regexp.MustCompile(`-----BEGIN [A-Z0-9 ]*PRIVATE KEY(?: BLOCK)?-----[\s\S]*?-----END [A-Z0-9 ]*PRIVATE KEY(?: BLOCK)?-----`),
+	},
+	{
+		Name: "aws-access-key-id",
+		rx:   regexp.MustCompile(`\b(?:AKIA|ASIA|AGPA|AIDA|AROA|ANPA|ANVA|AIPA)[0-9A-Z]{16}\b`),
+	},
+	{
+		Name: "aws-secret-access-key",
+		rx:   regexp.MustCompile(`(?i)aws_?secret_?(?:access_?)?key["']?\s*[:=]\s*["']?([A-Za-z0-9/+=]{40})\b`),
+	},
+	{
+		Name: "jwt",
+		rx:   regexp.MustCompile(`\beyJ[A-Za-z0-9_-]{5,}\.eyJ[A-Za-z0-9_-]{5,}\.[A-Za-z0-9_-]{10,}`),
+	},
+	{
+		Name:        "high-entropy",
+		rx:          regexp.MustCompile(`[A-Za-z0-9+/_-]{24,}={0,2}`),
+		check:       isHighEntropy,
+		noChecksums: true,
+	},
+}
+
+func init() {
+	for i := range builtinRedactRules {
+		builtinRedactRules[i].Source = "built-in"
+	}
+}
+
+// isHighEntropy returns true for strings that look like random keys or
+// tokens: letters and digits with more than 4.3 bits of entropy per character.
+// Hex digests stay below that.
+func isHighEntropy(s string) bool {
+	hasDigit := strings.IndexFunc(s, unicode.IsDigit) >= 0
+	hasLetter := strings.IndexFunc(s, unicode.IsLetter) >= 0
+	if !hasDigit || !hasLetter {
+		return false
+	}
+	counts := map[rune]int{}
+	for _, r := range s {
+		counts[r]++
+	}
+	entropy := 0.0
+	for _, n := range counts {
+		p := float64(n) / float64(len(s))
+		entropy -= p * math.Log2(p)
+	}
+	return entropy > 4.3
+}
+
+// redactEnabled returns true if flatten masks secrets, by default it does
+// for LLM prompts
+func redactEnabled() bool {
+	if NoRedact {
+		return false
+	}
+	return Redact || wantsPrompt()
+}
+
+var (
+	redactRulesLock  sync.Mutex
+	redactRulesCache = map[string][]redactRule{}
+)
+
+// loadRedactRules returns the built-in rules followed by the ones of the
+// first .flattenredact in dir or its parents. Every line of it is a regular
+// expression, empty lines and lines starting with # are skipped.
+func loadRedactRules(dir string) ([]redactRule, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	redactRulesLock.Lock()
+	defer redactRulesLock.Unlock()
+	if rules, ok := redactRulesCache[dir]; ok {
+		return rules, nil
+	}
+
+	rules := append([]redactRule{}, builtinRedactRules...)
+	for d := dir; ; d = filepath.Dir(d) {
+		path := filepath.Join(d, redactFileName)
+		f, err := os.Open(path)
+		if os.IsNotExist(err) {
+			if filepath.Dir(d) == d {
+				break
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		for lineNo := 1; scanner.Scan(); lineNo++ {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			rx, err := regexp.Compile(line)
+			if err != nil {
+				f.Close()
+				return nil, fmt.Errorf("%s:%d: %w", path, lineNo, err)
+			}
+			rules = append(rules, redactRule{Name: "custom", Source: path, Line: lineNo, rx: rx})
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		break
+	}
+
+	redactRulesCache[dir] = rules
+	return rules, nil
+}
+
+// redaction is a secret that was found in a file
+type redaction struct {
+	Start, End  int // byte offsets in the content
+	Rule        *redactRule
+	Placeholder string
+}
+
+// findSecrets returns the secrets in content in order, where rules overlap
+// the one that starts first (or comes first) wins. The same secret always
+// gets the same placeholder. They are numbered in the order they appear in
+// content, so the numbers only depend on the file itself: expand finds them
+// again in the file on disk.
+func findSecrets(content string, rules []redactRule) []redaction {
+	var found []redaction
+	for i := range rules {
+		rule := &rules[i]
+		for _, m := range rule.rx.FindAllStringSubmatchIndex(content, -1) {
+			start, end := m[0], m[1]
+			if len(m) >= 4 && m[2] >= 0 {
+				start, end = m[2], m[3]
+			}
+			if start == end || rule.check != nil && !rule.check(content[start:end]) {
+				continue
+			}
+			found = append(found, redaction{Start: start, End: end, Rule: rule})
+		}
+	}
+	sort.SliceStable(found, func(i, j int) bool {
+		return found[i].Start < found[j].Start
+	})
+
+	var secrets []redaction
+	numbers := map[string]int{}
+	end := 0
+	for _, r := range found {
+		if r.Start < end {
+			continue // overlaps a secret that was already found
+		}
+		secret := content[r.Start:r.End]
+		n, ok := numbers[secret]
+		if !ok {
+			n = len(numbers) + 1
+			numbers[secret] = n
+		}
+		r.Placeholder = fmt.Sprintf("[REDACTED:%s:%d]", r.Rule.Name, n)
+		secrets = append(secrets, r)
+		end = r.End
+	}
+	return secrets
+}
+
+// redactContent replaces the secrets in content with their placeholders
+func redactContent(content string, secrets []redaction) string {
+	var out strings.Builder
+	last := 0
+	for _, s := range secrets {
+		out.WriteString(content[last:s.Start])
+		out.WriteString(s.Placeholder)
+		last = s.End
+	}
+	out.WriteString(content[last:])
+	return out.String()
+}
+
+// redactEntry masks the secrets in the content of entry p and reports them on
+// stderr. It's called for the entries in sorted path order, after they were
+// read, so the report doesn't depend on --jobs either.
+func redactEntry(p string, entry Entry) (Entry, error) {
+	if entry.isSymlink() || entry.isBase64() {
+		return entry, nil
+	}
+	rules, err := loadRedactRules(".")
+	if err != nil {
+		return entry, err
+	}
+	secrets := findSecrets(entry.Content, redactRulesFor(p, rules))
+	if len(secrets) == 0 {
+		return entry, nil
+	}
+	for _, s := range secrets {
+		line := strings.Count(entry.Content[:s.Start], "\n") + 1
+		source := s.Rule.Source
+		if s.Rule.Line > 0 {
+			source = fmt.Sprintf("%s:%d", s.Rule.Source, s.Rule.Line)
+		}
+		fmt.Fprintf(os.Stderr, "redacted: %s:%d %s (%s)\n", p, line, s.Placeholder, source)
+	}
+	entry.Content = redactContent(entry.Content, secrets)
+	return entry, nil
+}
+
+// restoreSecrets puts the secrets of old (the file on disk) back in place of
+// the placeholders in content. It fails if a placeholder isn't in old.
+func restoreSecrets(content string, old string, rules []redactRule) (string, error) {
+	secrets := map[string]string{}
+	for _, s := range findSecrets(old, rules) {
+		secrets[s.Placeholder] = old[s.Start:s.End]
+	}
+	var missing []string
+	restored := rePlaceholder.ReplaceAllStringFunc(content, func(placeholder string) string {
+		secret, ok := secrets[placeholder]
+		if !ok {
+			missing = append(missing, placeholder)
+			return placeholder
+		}
+		return secret
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("can't restore %s", strings.Join(missing, ", "))
+	}
+	return restored, nil
+}
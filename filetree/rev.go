@@ -0,0 +1,208 @@
+package filetree
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mrvnmyr/oat/common"
+)
+
+// Rev makes flatten read the files of this git revision instead of the
+// working directory
+var Rev string = ""
+
+// revFile is a file listed by git ls-tree
+type revFile struct {
+	Mode   string // e.g. "100644"
+	Type   string // "blob", "tree" or "commit"
+	Object string
+	Path   string // relative to the directory git ran in
+}
+
+// lsTree lists the files of rev below dir (or the given paths)
+func lsTree(dir string, rev string, paths []string) ([]revFile, error) {
+	if err := verifyRev(dir, rev, ""); err != nil {
+		return nil, err
+	}
+	// no "--" after the rev, ls-tree would take it for a path
+	args := append([]string{"ls-tree", "-r", "-z", "--end-of-options", rev}, paths...)
+	out, err := runGit(dir, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []revFile
+	for _, line := range splitNul(out) {
+		meta, p, ok := strings.Cut(line, "\t")
+		if !ok {
+			return nil, fmt.Errorf("unexpected git ls-tree output: %q", line)
+		}
+		fields := strings.Fields(meta)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("unexpected git ls-tree output: %q", line)
+		}
+		files = append(files, revFile{
+			Mode:   fields[0],
+			Type:   fields[1],
+			Object: fields[2],
+			Path:   p,
+		})
+	}
+	return files, nil
+}
+
+// catFiles reads the contents of objects with a single git cat-file --batch
+// and calls fn with each of them in order
+func catFiles(dir string, objects []string, fn func(object string, content []byte) error) error {
+	if len(objects) == 0 {
+		return nil
+	}
+	common.Debugf("Running: git -C %s cat-file --batch (%d objects)\n", dir, len(objects))
+
+	cmd := exec.Command("git", "-C", dir, "cat-file", "--batch")
+	cmd.Stdin = strings.NewReader(strings.Join(objects, "\n") + "\n")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	// git may still be writing, it would block on the full pipe forever
+	stop := func(err error) error {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	r := bufio.NewReader(stdout)
+	for _, object := range objects {
+		header, err := r.ReadString('\n')
+		if err != nil {
+			return stop(fmt.Errorf("git cat-file: %w: %s", err, strings.TrimSpace(stderr.String())))
+		}
+		fields := strings.Fields(header)
+		if len(fields) != 3 {
+			return stop(fmt.Errorf("git cat-file: %s", strings.TrimSpace(header)))
+		}
+		size, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return stop(fmt.Errorf("git cat-file: unexpected header %q", header))
+		}
+		b := make([]byte, size+1) // content and a trailing LF
+		if _, err := io.ReadFull(r, b); err != nil {
+			return stop(fmt.Errorf("git cat-file: %w", err))
+		}
+		if err := fn(object, b[:size]); err != nil {
+			return stop(err)
+		}
+	}
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("git cat-file: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// revPerm translates a git file mode to an Entry perm
+func revPerm(mode string) string {
+	if mode == "100755" {
+		return "0755"
+	}
+	return "0644"
+}
+
+// RevTreeToYAML flattens the files of a git revision without checking it out.
+// Without paths the root and rules come from .flattenignore/.flattenallow like
+// in DirTreeToYAML, otherwise paths are relative to the working directory.
+// .gitignore files are not applied since a revision only has tracked files.
+func RevTreeToYAML(rev string, paths []string, yamlPath string, noIgnores bool) error {
+	var err error
+
+	dir := ""
+	templateDir := ""
+	if len(paths) == 0 {
+		dir, err = findRootAndPopulateFromDotFlattenFile(dir)
+		if err != nil {
+			return err
+		}
+		templateDir = dir
+		noIgnores = false
+	} else {
+		dir, err = os.Getwd()
+		if err != nil {
+			return err
+		}
+	}
+
+	selection, err := gitSelection(dir)
+	if err != nil {
+		return err
+	}
+	files, err := lsTree(dir, rev, paths)
+	if err != nil {
+		return err
+	}
+
+	var wanted []revFile
+	for _, f := range files {
+		if !AllowOutsideRoot && (f.Path == ".." || strings.HasPrefix(f.Path, "../")) {
+			return fmt.Errorf("%s is outside of the working directory (see --allow-outside-root)", f.Path)
+		}
+		if f.Type != "blob" {
+			continue // submodules
+		}
+		if noIgnores {
+			if selection != nil && !selection[f.Path] {
+				continue
+			}
+		} else {
+			if shouldIgnore(f.Path, false) {
+				continue
+			}
+			if !isSelected(f.Path, selection) {
+				continue
+			}
+		}
+		wanted = append(wanted, f)
+	}
+
+	sort.Slice(wanted, func(i, j int) bool {
+		return wanted[i].Path < wanted[j].Path
+	})
+	objects := make([]string, 0, len(wanted))
+	for _, f := range wanted {
+		objects = append(objects, f.Object)
+	}
+
+	return writeEntries(yamlPath, templateDir, func(emit func(p string, entry Entry) error) error {
+		i := 0
+		return catFiles(dir, objects, func(object string, b []byte) error {
+			f := wanted[i]
+			i++
+			if f.Mode == "120000" {
+				// the blob of a symlink is its target
+				return emit(f.Path, Entry{Type: EntryTypeSymlink, Target: string(b)})
+			}
+			isBin := isLikelyBinary(b)
+			if isBin && !includeBinary(f.Path, int64(len(b))) {
+				return nil
+			}
+			skip, truncate, err := sizeLimit(f.Path, int64(len(b)), isBin)
+			if err != nil || skip {
+				return err
+			}
+			if truncate {
+				return emit(f.Path, truncateContent(revPerm(f.Mode), b))
+			}
+			return emit(f.Path, contentEntry(revPerm(f.Mode), b))
+		})
+	})
+}
@@ -0,0 +1,115 @@
+package filetree
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// gitTestRepo creates a repository with files committed and changes into it
+func gitTestRepo(t *testing.T, files map[string]string) string {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	dir := t.TempDir()
+	writeTestFiles(t, dir, files)
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"add", "-A"},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "files"},
+	} {
+		if _, err := runGit(dir, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Chdir(dir)
+	return dir
+}
+
+func TestRevTree(t *testing.T) {
+	gitTestRepo(t, map[string]string{
+		".flattenignore": "*.log\n",
+		"a.txt":          "a\n",
+		"b.log":          "b\n",
+		"sub/c.txt":      "c\n",
+		"-dash.txt":      "dash\n",
+	})
+	// the working directory isn't what's flattened
+	writeTestFiles(t, ".", map[string]string{"a.txt": "changed\n", "new.txt": "new\n"})
+
+	for _, c := range []struct {
+		name  string
+		paths []string
+		want  map[string]string
+	}{
+		{"no args", nil, map[string]string{".flattenignore": "*.log\n", "a.txt": "a\n", "sub/c.txt": "c\n", "-dash.txt": "dash\n"}},
+		{"dir", []string{"sub"}, map[string]string{"sub/c.txt": "c\n"}},
+		{"files", []string{"a.txt", "-dash.txt"}, map[string]string{"a.txt": "a\n", "-dash.txt": "dash\n"}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			defer keep(&IgnoredGlobs)()
+			defer keep(&AllowedGlobs)()
+			defer keep(&OutputFormat)()
+			OutputFormat = FormatYAML
+
+			out := filepath.Join(t.TempDir(), "out.yaml")
+			if err := RevTreeToYAML("HEAD", c.paths, out, false); err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tree, err := decodeTree(data, FormatYAML)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := map[string]string{}
+			for p, entry := range tree {
+				got[p] = entry.Content
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("got %q, want %q", got, c.want)
+			}
+		})
+	}
+
+	defer keep(&IgnoredGlobs)()
+	defer keep(&AllowedGlobs)()
+	if err := RevTreeToYAML("--output=x", nil, filepath.Join(t.TempDir(), "out.yaml"), false); err == nil {
+		t.Error("an option was taken for a revision")
+	}
+}
+
+// catFiles has to stop git when it gives up early, git would otherwise block
+// writing the objects that are still to come
+func TestCatFilesStopsGit(t *testing.T) {
+	big := strings.Repeat("0123456789abcdef\n", 1<<14) // larger than a pipe buffer
+	gitTestRepo(t, map[string]string{"big.txt": big})
+	files, err := lsTree(".", "HEAD", nil)
+	if err != nil || len(files) != 1 {
+		t.Fatalf("ls-tree: %v %v", files, err)
+	}
+	objects := []string{"0000000000000000000000000000000000000000"}
+	for range 8 {
+		objects = append(objects, files[0].Object)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- catFiles(".", objects, func(string, []byte) error { return nil })
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("a missing object was read")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("catFiles hangs")
+	}
+}
@@ -0,0 +1,93 @@
+package filetree
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// AllowOutsideRoot lets flatten emit absolute keys for paths outside the
+// working directory and lets expand write wherever the keys point to
+var AllowOutsideRoot bool = false
+
+// resolveDest returns where the tree key p is written below destRoot. Unless
+// AllowOutsideRoot is set it rejects keys that are absolute or escape
+// destRoot via "..", parents that are symlinks and targets that are no
+// regular files or symlinks (devices, fifos, sockets). Expand replaces
+// symlinks, it never writes to where they point.
+func resolveDest(destRoot string, p string) (string, error) {
+	local := filepath.FromSlash(p)
+	full := filepath.Join(destRoot, local)
+	if AllowOutsideRoot {
+		return full, nil
+	}
+
+	if !filepath.IsLocal(local) {
+		return "", fmt.Errorf("%s: path escapes the output root (see --allow-outside-root)", p)
+	}
+
+	dir := destRoot
+	parts := strings.Split(filepath.Clean(local), string(filepath.Separator))
+	for i, part := range parts {
+		dir = filepath.Join(dir, part)
+		info, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			break // the rest gets created
+		}
+		if err != nil {
+			return "", err
+		}
+		last := i == len(parts)-1
+		if info.Mode()&os.ModeSymlink != 0 {
+			if last {
+				break
+			}
+			return "", fmt.Errorf("%s: %s is a symlink (see --allow-outside-root)", p, dir)
+		}
+		if last && !info.Mode().IsRegular() && !info.IsDir() {
+			return "", fmt.Errorf("%s: %s is not a regular file", p, dir)
+		}
+	}
+	return full, nil
+}
+
+// checkSymlinkTarget rejects symlinks pointing outside of the output root
+// (absolute or via "..") unless AllowOutsideRoot is set
+func checkSymlinkTarget(p string, target string) error {
+	if AllowOutsideRoot {
+		return nil
+	}
+	if target == "" {
+		return fmt.Errorf("%s: symlink without a target", p)
+	}
+	if path.IsAbs(target) || filepath.IsAbs(filepath.FromSlash(target)) {
+		return fmt.Errorf("%s: symlink target %s is absolute (see --allow-outside-root)", p, target)
+	}
+	if !filepath.IsLocal(filepath.FromSlash(path.Join(path.Dir(p), target))) {
+		return fmt.Errorf("%s: symlink target %s escapes the output root (see --allow-outside-root)", p, target)
+	}
+	return nil
+}
+
+// checkTreeLinks rejects entries below a symlink entry of the same tree. The
+// link only exists once it's expanded, so resolveDest can't see it yet.
+func checkTreeLinks(tree map[string]Entry) error {
+	if AllowOutsideRoot {
+		return nil
+	}
+	for _, p := range sortedPaths(tree) {
+		for _, key := range []string{p, tree[p].RenamedFrom} {
+			if key == "" {
+				continue
+			}
+			for dir := path.Dir(path.Clean(key)); dir != "." && dir != "/"; dir = path.Dir(dir) {
+				if entry, ok := tree[dir]; ok && entry.isSymlink() && !entry.Delete {
+					return fmt.Errorf("%s: %s is a symlink in the tree (see --allow-outside-root)", key, dir)
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package filetree
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveDest(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	writeTestFiles(t, root, map[string]string{"dir/file.txt": "x"})
+	for link, target := range map[string]string{
+		"out":        outside, // leads out of the root
+		"in":         "dir",   // stays in it, but is still a symlink
+		"chain":      "out",   // a symlink to a symlink
+		"dir/parent": filepath.Join("..", "out"),
+	} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if l, err := net.Listen("unix", filepath.Join(root, "sock")); err == nil {
+		defer l.Close()
+	}
+
+	for _, c := range []struct {
+		key string
+		ok  bool // --allow-outside-root accepts them all
+	}{
+		{"dir/file.txt", true},
+		{"new/deep/file.txt", true},
+		{"dir/../x.txt", true},
+		{"..", false},
+		{"../x.txt", false},
+		{"a/../../x.txt", false},
+		{"dir/../../x.txt", false},
+		{"/etc/passwd", false},
+		{"out", true}, // the last component is replaced, not followed
+		{"out/x.txt", false},
+		{"in/x.txt", false},
+		{"chain/x.txt", false},
+		{"dir/parent/x.txt", false},
+		{"dir", true},
+		{"sock", false},
+	} {
+		t.Run(c.key, func(t *testing.T) {
+			if c.key == "sock" {
+				if _, err := os.Lstat(filepath.Join(root, "sock")); err != nil {
+					t.Skip("no unix socket:", err)
+				}
+			}
+			defer keep(&AllowOutsideRoot)()
+			want := filepath.Join(root, filepath.FromSlash(c.key))
+			AllowOutsideRoot = false
+			full, err := resolveDest(root, c.key)
+			if (err == nil) != c.ok {
+				t.Errorf("got error %v, want ok %v", err, c.ok)
+			} else if err == nil && full != want {
+				t.Errorf("got %s, want %s", full, want)
+			}
+			AllowOutsideRoot = true
+			if full, err := resolveDest(root, c.key); err != nil || full != want {
+				t.Errorf("with --allow-outside-root: got %s, %v", full, err)
+			}
+		})
+	}
+}
+
+func TestCheckSymlinkTarget(t *testing.T) {
+	for _, c := range []struct {
+		key, target string
+		ok          bool
+	}{
+		{"link", "file.txt", true},
+		{"link", "a/../b", true},
+		{"dir/link", "../file.txt", true},
+		{"dir/link", "sub/../../file.txt", true},
+		{"a/b/link", "../../c/../d", true},
+		{"link", "", false},
+		{"link", "..", false},
+		{"link", "../x", false},
+		{"link", "a/../../x", false},
+		{"dir/link", "../..", false},
+		{"a/b/link", "../../../x", false},
+		{"link", "/etc", false},
+		{"dir/link", "/etc/passwd", false},
+	} {
+		t.Run(c.key+" -> "+c.target, func(t *testing.T) {
+			defer keep(&AllowOutsideRoot)()
+			AllowOutsideRoot = false
+			if err := checkSymlinkTarget(c.key, c.target); (err == nil) != c.ok {
+				t.Errorf("got error %v, want ok %v", err, c.ok)
+			}
+			AllowOutsideRoot = true
+			if err := checkSymlinkTarget(c.key, c.target); err != nil {
+				t.Errorf("with --allow-outside-root: %v", err)
+			}
+		})
+	}
+}
+
+// Symlink entries are only created by expand, chains of them must be caught
+// before anything is written
+func TestCheckTreeLinks(t *testing.T) {
+	link := func(target string) Entry { return Entry{Type: EntryTypeSymlink, Target: target} }
+	for _, c := range []struct {
+		name string
+		tree map[string]Entry
+		ok   bool
+	}{
+		{"sibling", map[string]Entry{"a": link("b"), "b/x.txt": {Content: "x"}}, true},
+		{"below", map[string]Entry{"a": link("b"), "a/x.txt": {Content: "x"}}, false},
+		{"deep below", map[string]Entry{"a": link("b"), "a/b/c/x.txt": {Content: "x"}}, false},
+		{"chained", map[string]Entry{"a": link("b"), "b": link(".."), "a/x.txt": {Content: "x"}}, false},
+		{"renamed from below", map[string]Entry{"a": link("b"), "x.txt": {RenamedFrom: "a/x.txt"}}, false},
+		{"deleted link", map[string]Entry{"a": {Type: EntryTypeSymlink, Delete: true}, "a/x.txt": {Content: "x"}}, true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			defer keep(&AllowOutsideRoot)()
+			AllowOutsideRoot = false
+			if err := checkTreeLinks(c.tree); (err == nil) != c.ok {
+				t.Errorf("got error %v, want ok %v", err, c.ok)
+			}
+			AllowOutsideRoot = true
+			if err := checkTreeLinks(c.tree); err != nil {
+				t.Errorf("with --allow-outside-root: %v", err)
+			}
+		})
+	}
+}
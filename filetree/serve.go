@@ -0,0 +1,515 @@
+package filetree
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ServeAddr is where serve listens
+	ServeAddr string = "127.0.0.1:8080"
+
+	// ServeToken is the bearer token serve requires, "" for none
+	ServeToken string = ""
+
+	// ServeTokenFile is read for the token, so it doesn't show up in ps
+	ServeTokenFile string = ""
+
+	// ServeOrigins are the browser origins (of extensions for example) that
+	// may call serve, requests from any other page are refused
+	ServeOrigins []string = []string{}
+
+	// ServeMaxBody is the largest tree expand accepts, in bytes
+	ServeMaxBody int64 = 64 << 20
+)
+
+// formatContentTypes are the content types of the flatten responses
+var formatContentTypes = map[string]string{
+	FormatYAML:  "application/yaml",
+	FormatJSON:  "application/json",
+	FormatJSONL: "application/jsonl",
+	FormatMD:    "text/markdown; charset=utf-8",
+	FormatTar:   "application/x-tar",
+	FormatTarGz: "application/gzip",
+	FormatZip:   "application/zip",
+}
+
+// Server serves flatten, expand and ls for the working directory over HTTP.
+// Requests run one at a time, the options are package globals.
+type Server struct {
+	// Token has to be sent as "Authorization: Bearer <token>" if it's set
+	Token string
+
+	// Origins are the browser origins that may call the server
+	Origins []string
+
+	lock sync.Mutex
+	mux  *http.ServeMux
+}
+
+// NewServer returns a Server for the working directory
+func NewServer(token string) *Server {
+	s := &Server{Token: token, Origins: ServeOrigins}
+	s.mux = http.NewServeMux()
+	s.mux.HandleFunc("GET /flatten", s.handleFlatten)
+	s.mux.HandleFunc("GET /ls", s.handleLs)
+	s.mux.HandleFunc("POST /expand", s.handleExpand)
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// a page that resolves its own name to 127.0.0.1 (DNS rebinding) would
+	// otherwise be allowed to read the responses
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	if host != "localhost" && net.ParseIP(strings.Trim(host, "[]")) == nil {
+		writeError(w, http.StatusForbidden, fmt.Errorf("host %s isn't allowed, use an IP address or localhost", r.Host))
+		return
+	}
+	// browsers send an Origin with requests from pages, which may write
+	// files with a simple POST even if they can't read the response
+	if origin := r.Header.Get("Origin"); origin != "" && !slices.Contains(s.Origins, origin) {
+		writeError(w, http.StatusForbidden, fmt.Errorf("origin %s isn't allowed (see --allow-origin)", origin))
+		return
+	}
+	if s.Token != "" {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.Token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, errors.New("missing or wrong bearer token"))
+			return
+		}
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// writeJSON writes v as the response
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		status, data = http.StatusInternalServerError, []byte(`{"error": "encoding the response failed"}`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(data, '\n'))
+}
+
+// writeError writes err as {"error": "..."}
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// keep returns a func that sets *p back to its current value
+func keep[T any](p *T) func() {
+	v := *p
+	return func() { *p = v }
+}
+
+// saveOptions returns a func that sets the options a request may change back
+// to their current values
+func saveOptions() func() {
+	restores := []func(){
+		keep(&IgnoredGlobs), keep(&AllowedGlobs), keep(&SkipBinaryFiles), keep(&BinaryGlobs),
+		keep(&MaxBinarySize), keep(&MaxFileSize), keep(&FileSizePolicy), keep(&TokenizerName),
+		keep(&MaxTokens), keep(&BudgetPolicy), keep(&PriorityGlobs), keep(&TokenReport),
+		keep(&LLM), keep(&Prompt), keep(&PromptFile), keep(&TemplateFile),
+		keep(&Redact), keep(&NoRedact), keep(&NoHash), keep(&Metadata),
+		keep(&OutputFormat), keep(&InputFormat), keep(&GitTracked), keep(&GitChanged),
+		keep(&GitStaged), keep(&NoGitignore), keep(&AllowOutsideRoot), keep(&FollowSymlinks),
+		keep(&DryRun), keep(&Interactive), keep(&OnConflict), keep(&PreserveTimes),
+	}
+	return func() {
+		for _, restore := range restores {
+			restore()
+		}
+	}
+}
+
+// queryOptions sets options from the query parameters, they're named like
+// the flags. Parameters that aren't used are an error.
+type queryOptions struct {
+	values url.Values
+	used   map[string]bool
+	err    error
+}
+
+func newQueryOptions(r *http.Request) *queryOptions {
+	return &queryOptions{values: r.URL.Query(), used: map[string]bool{}}
+}
+
+func (q *queryOptions) lookup(name string) ([]string, bool) {
+	q.used[name] = true
+	vs, ok := q.values[name]
+	return vs, ok
+}
+
+func (q *queryOptions) fail(name string, err error) {
+	if q.err == nil {
+		q.err = fmt.Errorf("%s: %w", name, err)
+	}
+}
+
+func (q *queryOptions) strings(name string, p *[]string) {
+	if vs, ok := q.lookup(name); ok {
+		*p = vs
+	}
+}
+
+func (q *queryOptions) string(name string, p *string) {
+	if vs, ok := q.lookup(name); ok {
+		*p = vs[len(vs)-1]
+	}
+}
+
+// bool takes a value like strconv.ParseBool, a parameter without one is true
+func (q *queryOptions) bool(name string, p *bool) {
+	if vs, ok := q.lookup(name); ok {
+		v := vs[len(vs)-1]
+		if v == "" {
+			*p = true
+			return
+		}
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			q.fail(name, err)
+		}
+		*p = b
+	}
+}
+
+func (q *queryOptions) int64(name string, p *int64) {
+	if vs, ok := q.lookup(name); ok {
+		n, err := strconv.ParseInt(vs[len(vs)-1], 10, 64)
+		if err != nil {
+			q.fail(name, err)
+		}
+		*p = n
+	}
+}
+
+func (q *queryOptions) int(name string, p *int) {
+	n := int64(*p)
+	q.int64(name, &n)
+	*p = int(n)
+}
+
+// done returns the first error, or that there are unknown parameters
+func (q *queryOptions) done() error {
+	if q.err != nil {
+		return q.err
+	}
+	var unknown []string
+	for name := range q.values {
+		if !q.used[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown parameters: %s", strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// selection sets the options that select the files, like the flags flatten
+// and ls share, and returns the paths. Paths have to stay below the working
+// directory, without any it's the .flattenignore/.flattenallow in it or the
+// whole directory. Revisions are only taken with a token, without one any
+// page the user visits can send requests.
+func (q *queryOptions) selection(withToken bool) (paths []string, noIgnores bool) {
+	q.strings("path", &paths)
+	if len(paths) == 0 && !hasDotFlattenFile(".") {
+		paths = []string{"."} // never look for one above it
+	}
+	for _, p := range paths {
+		if _, err := resolveDest(".", p); err != nil {
+			q.fail("path", err)
+		}
+	}
+	q.bool("no-ignores", &noIgnores)
+	q.strings("ignored-globs", &IgnoredGlobs)
+	q.strings("allowed-globs", &AllowedGlobs)
+	q.bool("no-gitignore", &NoGitignore)
+	q.bool("git-tracked", &GitTracked)
+	if withToken {
+		q.string("git-changed", &GitChanged)
+	} else if _, ok := q.lookup("git-changed"); ok {
+		q.fail("git-changed", errors.New("only allowed if serve has a --token"))
+	}
+	q.bool("git-staged", &GitStaged)
+	q.bool("skip-binary-files", &SkipBinaryFiles)
+	q.strings("binary-globs", &BinaryGlobs)
+	q.int64("max-binary-size", &MaxBinarySize)
+	q.int64("max-file-size", &MaxFileSize)
+	q.string("file-size-policy", &FileSizePolicy)
+	q.string("tokenizer", &TokenizerName)
+	return paths, noIgnores
+}
+
+// handleFlatten responds with the flattened tree in the requested format
+func (s *Server) handleFlatten(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	defer saveOptions()()
+
+	q := newQueryOptions(r)
+	paths, noIgnores := q.selection(s.Token != "")
+	q.string("format", &OutputFormat)
+	q.int("max-tokens", &MaxTokens)
+	q.string("budget-policy", &BudgetPolicy)
+	q.strings("priority-globs", &PriorityGlobs)
+	q.bool("llm", &LLM)
+	q.string("prompt", &Prompt)
+	q.bool("redact", &Redact)
+	q.bool("no-redact", &NoRedact)
+	q.bool("no-hash", &NoHash)
+	q.bool("metadata", &Metadata)
+	if err := q.done(); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	contentType, ok := formatContentTypes[OutputFormat]
+	if !ok {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unknown format: %s", OutputFormat))
+		return
+	}
+	if wantsPrompt() {
+		contentType = "text/plain; charset=utf-8"
+	}
+
+	files, templateDir, err := collectFiles(paths, noIgnores)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	read := func(emit func(p string, entry Entry) error) error {
+		return readFiles(sortFiles(files), emit)
+	}
+	var out bytes.Buffer
+	if needsWholeTree() {
+		var tree map[string]Entry
+		var result []byte
+		if tree, err = readTree(read); err == nil {
+			if result, err = renderTree(tree, templateDir); err == nil {
+				out.Write(result)
+			}
+		}
+	} else {
+		err = streamEntries(&out, read)
+	}
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Write(out.Bytes())
+}
+
+// lsEntry is a file or directory in the response of ls
+type lsEntry struct {
+	Path     string   `json:"path"`
+	Dir      bool     `json:"dir,omitempty"`
+	Files    int      `json:"files,omitempty"`
+	Size     int64    `json:"size"`
+	Tokens   int      `json:"tokens"`
+	Flags    []string `json:"flags,omitempty"`
+	Excluded string   `json:"excluded,omitempty"`
+}
+
+// handleLs responds with what ls prints: every included and excluded path
+// and the totals
+func (s *Server) handleLs(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	defer saveOptions()()
+
+	q := newQueryOptions(r)
+	paths, noIgnores := q.selection(s.Token != "")
+	if err := q.done(); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	root, excludedCount, err := listTree(paths, noIgnores)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	entries := []lsEntry{}
+	root.walk("", func(relPath string, item *lsItem) {
+		e := lsEntry{Path: relPath, Dir: item.IsDir, Excluded: item.Reason}
+		if item.Reason == "" {
+			e.Size, e.Tokens, e.Flags = item.Size, item.Tokens, item.Flags
+		}
+		if e.Dir {
+			e.Path += "/"
+			e.Files = item.Files
+		}
+		entries = append(entries, e)
+	})
+	writeJSON(w, http.StatusOK, map[string]any{
+		"files":    root.Files,
+		"size":     root.Size,
+		"tokens":   root.Tokens,
+		"excluded": excludedCount,
+		"entries":  entries,
+	})
+}
+
+// expandChange is a change in the response of expand
+type expandChange struct {
+	Path           string `json:"path"`
+	Kind           string `json:"kind"`
+	From           string `json:"from,omitempty"`
+	Conflict       string `json:"conflict,omitempty"`
+	MergeConflicts int    `json:"merge_conflicts,omitempty"`
+	Skip           string `json:"skip,omitempty"`
+	Diff           string `json:"diff,omitempty"`
+}
+
+// handleExpand expands the tree in the body below dest (the working directory
+// by default) and responds with the changes, with dry-run they are only
+// previewed with their diffs. The body may be a whole model reply like for
+// expand.
+func (s *Server) handleExpand(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	defer saveOptions()()
+
+	dest := "."
+	q := newQueryOptions(r)
+	q.string("dest", &dest)
+	q.string("format", &InputFormat)
+	q.bool("dry-run", &DryRun)
+	q.string("on-conflict", &OnConflict)
+	q.bool("preserve-times", &PreserveTimes)
+	if err := q.done(); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if _, err := resolveDest(".", dest); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("dest: %w", err))
+		return
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, ServeMaxBody))
+	if err != nil {
+		writeError(w, http.StatusRequestEntityTooLarge, err)
+		return
+	}
+	var tree map[string]Entry
+	var cut []string
+	if InputFormat != "" {
+		tree, err = decodeTree(data, InputFormat)
+	} else {
+		tree, cut, err = extractTree(data)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if cut == nil {
+		cut = []string{}
+	}
+
+	changes, err := planExpand(tree, dest, nil)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	result := []expandChange{}
+	var conflicting []string
+	for _, c := range changes {
+		if c.Kind == changeNone && c.Skip == "" && c.Conflict == "" {
+			continue
+		}
+		e := expandChange{Path: c.Path, Kind: c.Kind, From: c.From, Conflict: c.Conflict, MergeConflicts: c.Conflicts, Skip: c.Skip}
+		if DryRun && c.Kind != changeNone {
+			e.Diff = c.diff(false)
+		}
+		result = append(result, e)
+		if c.Conflict != "" {
+			conflicting = append(conflicting, c.Path)
+		}
+	}
+	response := map[string]any{"dry_run": DryRun, "applied": false, "changes": result, "cut": cut}
+
+	if DryRun {
+		writeJSON(w, http.StatusOK, response)
+		return
+	}
+	if len(conflicting) > 0 && OnConflict == ConflictRefuse {
+		response["error"] = fmt.Sprintf("refusing to expand, %d files changed since they were flattened: %s (see on-conflict)",
+			len(conflicting), strings.Join(conflicting, ", "))
+		writeJSON(w, http.StatusConflict, response)
+		return
+	}
+	for _, c := range applyOrder(changes) {
+		if err := c.apply(); err != nil {
+			// the changes before it are written
+			response["error"] = err.Error()
+			writeJSON(w, http.StatusInternalServerError, response)
+			return
+		}
+	}
+	response["applied"] = true
+	writeJSON(w, http.StatusOK, response)
+}
+
+// Serve serves root (the working directory if it's "") on ServeAddr until
+// it's killed
+func Serve(root string) error {
+	if root != "" {
+		if err := os.Chdir(root); err != nil {
+			return err
+		}
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+
+	token := ServeToken
+	if ServeTokenFile != "" {
+		data, err := os.ReadFile(ServeTokenFile)
+		if err != nil {
+			return err
+		}
+		token = strings.TrimSpace(string(data))
+		if token == "" {
+			return fmt.Errorf("%s is empty", ServeTokenFile)
+		}
+	}
+
+	ln, err := net.Listen("tcp", ServeAddr)
+	if err != nil {
+		return err
+	}
+	if addr, ok := ln.Addr().(*net.TCPAddr); ok && !addr.IP.IsLoopback() && token == "" {
+		fmt.Fprintf(os.Stderr, "warning: listening on %s without a --token, anyone who can reach it can read and write %s\n", addr, cwd)
+	}
+	fmt.Fprintf(os.Stderr, "serving %s on http://%s\n", filepath.ToSlash(cwd), ln.Addr())
+
+	srv := &http.Server{
+		Handler:           NewServer(token),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return srv.Serve(ln)
+}
@@ -0,0 +1,223 @@
+package filetree
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// serveRequest sends a request to s from localhost and returns the response
+func serveRequest(t *testing.T, s *Server, method, target, body string, header map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.Host = "127.0.0.1:8080"
+	for k, v := range header {
+		if k == "Host" {
+			r.Host = v
+			continue
+		}
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+// serveDir changes into a new directory with files for the test
+func serveDir(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	writeTestFiles(t, dir, files)
+	t.Chdir(dir)
+	return dir
+}
+
+func TestServeToken(t *testing.T) {
+	serveDir(t, map[string]string{"a.txt": "a\n"})
+	s := NewServer("secret")
+	for _, c := range []struct {
+		auth string
+		want int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"secret", http.StatusUnauthorized},
+		{"Basic secret", http.StatusUnauthorized},
+		{"Bearer secret", http.StatusOK},
+	} {
+		header := map[string]string{}
+		if c.auth != "" {
+			header["Authorization"] = c.auth
+		}
+		w := serveRequest(t, s, "GET", "/ls", "", header)
+		if w.Code != c.want {
+			t.Errorf("Authorization %q: status %d, want %d: %s", c.auth, w.Code, c.want, w.Body)
+		}
+		if c.want == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") != "Bearer" {
+			t.Errorf("Authorization %q: no WWW-Authenticate header", c.auth)
+		}
+	}
+}
+
+func TestServeHostAndOrigin(t *testing.T) {
+	serveDir(t, map[string]string{"a.txt": "a\n"})
+	s := NewServer("")
+	s.Origins = []string{"chrome-extension://abc"}
+	for _, c := range []struct {
+		host, origin string
+		want         int
+	}{
+		{"127.0.0.1:8080", "", http.StatusOK}, // curl and scripts don't send an Origin
+		{"localhost:8080", "", http.StatusOK},
+		{"localhost", "", http.StatusOK},
+		{"[::1]:8080", "", http.StatusOK},
+		{"evil.example:8080", "", http.StatusForbidden}, // DNS rebinding
+		{"127.0.0.1.nip.io", "", http.StatusForbidden},
+		{"127.0.0.1:8080", "chrome-extension://abc", http.StatusOK},
+		{"127.0.0.1:8080", "https://evil.example", http.StatusForbidden},
+		{"127.0.0.1:8080", "null", http.StatusForbidden},
+	} {
+		header := map[string]string{"Host": c.host}
+		if c.origin != "" {
+			header["Origin"] = c.origin
+		}
+		if w := serveRequest(t, s, "GET", "/ls", "", header); w.Code != c.want {
+			t.Errorf("host %s, origin %q: status %d, want %d: %s", c.host, c.origin, w.Code, c.want, w.Body)
+		}
+	}
+
+	// a page may not write files with a simple POST either
+	w := serveRequest(t, s, "POST", "/expand?format=yaml", "b.txt:\n  content: b\n", map[string]string{"Origin": "https://evil.example"})
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expand from another origin: status %d", w.Code)
+	}
+	if _, err := os.Stat("b.txt"); !os.IsNotExist(err) {
+		t.Errorf("expand from another origin wrote b.txt")
+	}
+}
+
+func TestServeRejectsPathsOutsideRoot(t *testing.T) {
+	dir := serveDir(t, map[string]string{"a.txt": "a\n"})
+	outside := filepath.Join(filepath.Dir(dir), "outside-"+filepath.Base(dir))
+	s := NewServer("")
+
+	for _, target := range []string{
+		"/ls?path=..",
+		"/ls?path=../x",
+		"/ls?path=" + outside,
+		"/flatten?path=a.txt&path=../x",
+		"/flatten?path=/etc/passwd",
+		"/flatten?git-changed=HEAD", // revisions need a token
+	} {
+		if w := serveRequest(t, s, "GET", target, "", nil); w.Code != http.StatusBadRequest {
+			t.Errorf("GET %s: status %d, want %d: %s", target, w.Code, http.StatusBadRequest, w.Body)
+		}
+	}
+	for _, target := range []string{"/expand?format=yaml&dest=..", "/expand?format=yaml&dest=" + outside} {
+		if w := serveRequest(t, s, "POST", target, "x.txt:\n  content: x\n", nil); w.Code != http.StatusBadRequest {
+			t.Errorf("POST %s: status %d, want %d: %s", target, w.Code, http.StatusBadRequest, w.Body)
+		}
+	}
+	body := "../x.txt:\n  content: x\n"
+	if w := serveRequest(t, s, "POST", "/expand?format=yaml", body, nil); w.Code == http.StatusOK {
+		t.Errorf("expand of ../x.txt succeeded: %s", w.Body)
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(dir), "x.txt")); !os.IsNotExist(err) {
+		t.Errorf("expand wrote outside of the root")
+	}
+}
+
+func TestServeExpandDryRun(t *testing.T) {
+	serveDir(t, map[string]string{"a.txt": "old\n"})
+	s := NewServer("")
+	body := "a.txt:\n  content: |\n    new\nb.txt:\n  content: |\n    added\n"
+
+	var response struct {
+		DryRun  bool           `json:"dry_run"`
+		Applied bool           `json:"applied"`
+		Changes []expandChange `json:"changes"`
+	}
+	w := serveRequest(t, s, "POST", "/expand?format=yaml&dry-run", body, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("dry run: status %d: %s", w.Code, w.Body)
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if !response.DryRun || response.Applied || len(response.Changes) != 2 {
+		t.Fatalf("dry run: unexpected response %s", w.Body)
+	}
+	for _, c := range response.Changes {
+		if c.Diff == "" {
+			t.Errorf("dry run: no diff for %s", c.Path)
+		}
+	}
+	if data, _ := os.ReadFile("a.txt"); string(data) != "old\n" {
+		t.Errorf("dry run changed a.txt to %q", data)
+	}
+	if _, err := os.Stat("b.txt"); !os.IsNotExist(err) {
+		t.Errorf("dry run wrote b.txt")
+	}
+
+	w = serveRequest(t, s, "POST", "/expand?format=yaml", body, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("apply: status %d: %s", w.Code, w.Body)
+	}
+	response.Changes = nil
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.DryRun || !response.Applied || len(response.Changes) != 2 || response.Changes[0].Diff != "" {
+		t.Fatalf("apply: unexpected response %s", w.Body)
+	}
+	for p, want := range map[string]string{"a.txt": "new\n", "b.txt": "added\n"} {
+		if data, _ := os.ReadFile(p); string(data) != want {
+			t.Errorf("%s is %q, want %q", p, data, want)
+		}
+	}
+}
+
+func TestServeRestoresOptions(t *testing.T) {
+	serveDir(t, map[string]string{"a.txt": "a\n", "b.log": "b\n"})
+	defer saveOptions()()
+	IgnoredGlobs = []string{".git/"}
+	OutputFormat = FormatYAML
+	SkipBinaryFiles = true
+	DryRun = false
+	s := NewServer("")
+
+	w := serveRequest(t, s, "GET", "/flatten?format=json&ignored-globs=*.log&skip-binary-files=false&no-hash", "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("flatten: status %d: %s", w.Code, w.Body)
+	}
+	var tree map[string]Entry
+	if err := json.Unmarshal(w.Body.Bytes(), &tree); err != nil {
+		t.Fatalf("flatten didn't return json: %v: %s", err, w.Body)
+	}
+	if _, ok := tree["b.log"]; ok || tree["a.txt"].Content != "a\n" || tree["a.txt"].Hash != "" {
+		t.Errorf("flatten ignored the options: %s", w.Body)
+	}
+	w = serveRequest(t, s, "POST", "/expand?format=yaml&dry-run", "c.txt:\n  content: c\n", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expand: status %d: %s", w.Code, w.Body)
+	}
+
+	if !reflect.DeepEqual(IgnoredGlobs, []string{".git/"}) || OutputFormat != FormatYAML || !SkipBinaryFiles || NoHash || DryRun || InputFormat != "" {
+		t.Errorf("options leaked out of the requests: %q %s %v %v %v %q", IgnoredGlobs, OutputFormat, SkipBinaryFiles, NoHash, DryRun, InputFormat)
+	}
+
+	// the next request gets the defaults again
+	w = serveRequest(t, s, "GET", "/flatten", "", nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "b.log:") {
+		t.Errorf("flatten after a request with options: status %d: %s", w.Code, w.Body)
+	}
+
+	if w := serveRequest(t, s, "GET", "/flatten?no-such-option=1", "", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown parameter: status %d", w.Code)
+	}
+}
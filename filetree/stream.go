@@ -0,0 +1,173 @@
+package filetree
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"runtime"
+	"sort"
+
+	"github.com/mrvnmyr/oat/common"
+)
+
+// Jobs is the number of files flatten reads in parallel
+var Jobs int = runtime.NumCPU()
+
+// flattenFile is a file the walk selected, it's read later
+type flattenFile struct {
+	Path string // key in the tree
+	Full string // where it's read from
+	Info os.FileInfo
+}
+
+type readJob struct {
+	file   flattenFile
+	result chan readResult
+}
+
+type readResult struct {
+	entry Entry
+	ok    bool // false for skipped binary files
+	err   error
+}
+
+// sortFiles sorts files by their key, of duplicates (a file passed twice) the
+// last one wins like it would in a map
+func sortFiles(files []flattenFile) []flattenFile {
+	sort.SliceStable(files, func(i, j int) bool {
+		return files[i].Path < files[j].Path
+	})
+	out := files[:0]
+	for i, f := range files {
+		if i+1 < len(files) && files[i+1].Path == f.Path {
+			continue
+		}
+		out = append(out, f)
+	}
+	return out
+}
+
+// readFiles reads files on a pool of Jobs workers and calls emit with the
+// entries in the order of files. Only a few more files than there are workers
+// are held in memory at a time.
+func readFiles(files []flattenFile, emit func(p string, entry Entry) error) error {
+	workers := max(Jobs, 1)
+	jobs := make(chan readJob)
+	pending := make(chan chan readResult, 2*workers)
+	done := make(chan struct{})
+	defer close(done)
+
+	for range workers {
+		go func() {
+			for job := range jobs {
+				entry, ok, err := readEntryCached(job.file)
+				job.result <- readResult{entry: entry, ok: ok, err: err}
+			}
+		}()
+	}
+
+	go func() {
+		defer close(jobs)
+		defer close(pending)
+		for _, f := range files {
+			result := make(chan readResult, 1)
+			select {
+			case pending <- result:
+			case <-done:
+				return
+			}
+			select {
+			case jobs <- readJob{file: f, result: result}:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	i := 0
+	for result := range pending {
+		r := <-result
+		p := files[i].Path
+		i++
+		if r.err != nil {
+			return r.err
+		}
+		if !r.ok {
+			continue
+		}
+		if err := emit(p, r.entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFiles reads files and writes them to outPath, see writeEntries
+func writeFiles(files []flattenFile, outPath string, templateDir string) error {
+	files = sortFiles(files)
+	return writeEntries(outPath, templateDir, func(emit func(p string, entry Entry) error) error {
+		return readFiles(files, emit)
+	})
+}
+
+// needsWholeTree returns true if the entries can't be written as they come,
+// the LLM prompt and the token budget/report need all of them
+func needsWholeTree() bool {
+	return wantsPrompt() || MaxTokens > 0 || TokenReport
+}
+
+// readTree collects the entries read emits
+func readTree(read func(emit func(p string, entry Entry) error) error) (map[string]Entry, error) {
+	tree := map[string]Entry{}
+	err := read(func(p string, entry Entry) error {
+		tree[p] = entry
+		return nil
+	})
+	return tree, err
+}
+
+// writeEntries writes the entries read emits (in sorted path order) to
+// outPath. They are encoded and written as they come, unless needsWholeTree.
+func writeEntries(outPath string, templateDir string, read func(emit func(p string, entry Entry) error) error) error {
+	if needsWholeTree() {
+		tree, err := readTree(read)
+		if err != nil {
+			return err
+		}
+		return writeTree(tree, outPath, templateDir)
+	}
+
+	out, err := common.CreateFileOrStd(outPath, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if err := streamEntries(out, read); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// streamEntries encodes the entries read emits in OutputFormat to w as they
+// come
+func streamEntries(w io.Writer, read func(emit func(p string, entry Entry) error) error) error {
+	buf := bufio.NewWriter(w)
+	tw, err := newTreeWriter(buf, OutputFormat)
+	if err != nil {
+		return err
+	}
+	err = read(func(p string, entry Entry) error {
+		entry, err := finishEntry(p, entry)
+		if err != nil {
+			return err
+		}
+		return tw.Write(p, entry)
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return buf.Flush()
+}
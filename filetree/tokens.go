@@ -0,0 +1,257 @@
+package filetree
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	BudgetPolicyError       = "error"
+	BudgetPolicyDropLargest = "drop-largest"
+	BudgetPolicyDropDeepest = "drop-deepest"
+)
+
+var (
+	// TokenizerName selects one of Tokenizers
+	TokenizerName string = "approx"
+
+	// MaxTokens is the token budget of the whole output, 0 means unlimited
+	MaxTokens int = 0
+
+	// BudgetPolicy decides what happens when MaxTokens is exceeded
+	BudgetPolicy string = BudgetPolicyError
+
+	// PriorityGlobs are dropped last, earlier globs have a higher priority
+	PriorityGlobs []string = []string{}
+
+	// TokenReport prints the tokens per file to stderr
+	TokenReport bool = false
+)
+
+// Tokenizer estimates how many tokens a model needs for a text
+type Tokenizer interface {
+	CountTokens(text string) int
+}
+
+// Tokenizers are the tokenizers selectable via --tokenizer
+var Tokenizers = map[string]Tokenizer{
+	"approx": ApproxTokenizer{},
+	"chars":  CharTokenizer{},
+}
+
+// CharTokenizer assumes 4 bytes per token
+type CharTokenizer struct{}
+
+func (CharTokenizer) CountTokens(text string) int {
+	return (len(text) + 3) / 4
+}
+
+// ApproxTokenizer mimics a BPE tokenizer: words are split into chunks of about
+// 4 bytes, every punctuation or non-ASCII rune is a token of its own, a single
+// space is merged into the following word and newlines are a token each.
+type ApproxTokenizer struct{}
+
+func (ApproxTokenizer) CountTokens(text string) int {
+	tokens := 0
+	for i := 0; i < len(text); {
+		r, size := utf8.DecodeRuneInString(text[i:])
+		switch {
+		case r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'):
+			n := 0
+			for i < len(text) {
+				c := text[i]
+				if !(c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z') {
+					break
+				}
+				n++
+				i++
+			}
+			tokens += (n + 3) / 4
+		case r == '\n':
+			tokens++
+			i += size
+		case r == ' ' || r == '\t' || r == '\r':
+			n := 0
+			for i < len(text) && (text[i] == ' ' || text[i] == '\t' || text[i] == '\r') {
+				n++
+				i++
+			}
+			if n > 1 {
+				tokens += (n + 3) / 4
+			}
+		default:
+			tokens++
+			i += size
+		}
+	}
+	return tokens
+}
+
+// currentTokenizer returns the tokenizer selected by TokenizerName
+func currentTokenizer() (Tokenizer, error) {
+	t, ok := Tokenizers[TokenizerName]
+	if !ok {
+		names := make([]string, 0, len(Tokenizers))
+		for name := range Tokenizers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown tokenizer %q (available: %s)", TokenizerName, strings.Join(names, ", "))
+	}
+	return t, nil
+}
+
+// entryTokens estimates the tokens a single file adds to the output
+func entryTokens(t Tokenizer, p string, entry Entry) int {
+	const overhead = 4 // keys, quoting, fences
+	return t.CountTokens(p) + t.CountTokens(entry.Content) + overhead
+}
+
+// treeTokens estimates the tokens of all files in tree
+func treeTokens(t Tokenizer, tree map[string]Entry) int {
+	total := 0
+	for p, entry := range tree {
+		total += entryTokens(t, p, entry)
+	}
+	return total
+}
+
+// outputTokens counts the tokens of the rendered output of tree. Archives
+// aren't text, for them it's the estimate of the files in them.
+func outputTokens(t Tokenizer, tree map[string]Entry, result []byte) int {
+	if isArchiveFormat(OutputFormat) {
+		return treeTokens(t, tree)
+	}
+	return t.CountTokens(string(result))
+}
+
+// priorityOf returns the index of the first matching PriorityGlobs entry, or
+// len(PriorityGlobs) if none matches
+func priorityOf(p string) int {
+	for i, glob := range PriorityGlobs {
+		if matchIncludeOnly(p, false, []string{glob}) {
+			return i
+		}
+	}
+	return len(PriorityGlobs)
+}
+
+// dropOrder returns the paths of tree, the ones to drop first at the front
+func dropOrder(t Tokenizer, tree map[string]Entry) []string {
+	paths := sortedPaths(tree)
+	tokens := map[string]int{}
+	for _, p := range paths {
+		tokens[p] = entryTokens(t, p, tree[p])
+	}
+
+	sort.SliceStable(paths, func(i, j int) bool {
+		pi, pj := priorityOf(paths[i]), priorityOf(paths[j])
+		if pi != pj {
+			return pi > pj // lowest priority first
+		}
+		switch BudgetPolicy {
+		case BudgetPolicyDropDeepest:
+			di, dj := strings.Count(paths[i], "/"), strings.Count(paths[j], "/")
+			if di != dj {
+				return di > dj
+			}
+		}
+		return tokens[paths[i]] > tokens[paths[j]]
+	})
+	return paths
+}
+
+// applyTokenBudget renders tree and drops files according to BudgetPolicy
+// until the output fits into MaxTokens, it returns the output, the remaining
+// tree and the dropped paths
+func applyTokenBudget(tree map[string]Entry, render func(map[string]Entry) ([]byte, error)) ([]byte, map[string]Entry, []string, error) {
+	result, err := render(tree)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if MaxTokens <= 0 {
+		return result, tree, nil, nil
+	}
+
+	t, err := currentTokenizer()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	total := outputTokens(t, tree, result)
+	if total <= MaxTokens {
+		return result, tree, nil, nil
+	}
+
+	switch BudgetPolicy {
+	case BudgetPolicyError:
+		return nil, nil, nil, fmt.Errorf("output has ~%d tokens which exceeds --max-tokens %d (use --token-report to see the largest files)", total, MaxTokens)
+	case BudgetPolicyDropLargest, BudgetPolicyDropDeepest:
+	default:
+		return nil, nil, nil, fmt.Errorf("unknown budget policy: %s", BudgetPolicy)
+	}
+
+	kept := make(map[string]Entry, len(tree))
+	for p, entry := range tree {
+		kept[p] = entry
+	}
+	// scale the per file estimates to what the format adds around them
+	ratio := 1.0
+	if estimated := treeTokens(t, tree); estimated > 0 {
+		ratio = float64(total) / float64(estimated)
+	}
+
+	var dropped []string
+	for _, p := range dropOrder(t, tree) {
+		if total <= MaxTokens {
+			break
+		}
+		total -= int(float64(entryTokens(t, p, kept[p])) * ratio)
+		delete(kept, p)
+		dropped = append(dropped, p)
+
+		if total <= MaxTokens {
+			// the per file numbers are estimates, check the real output
+			result, err = render(kept)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			total = outputTokens(t, kept, result)
+		}
+	}
+	if total > MaxTokens {
+		return nil, nil, nil, fmt.Errorf("output has ~%d tokens without any files which exceeds --max-tokens %d", total, MaxTokens)
+	}
+	return result, kept, dropped, nil
+}
+
+// reportTokens prints the tokens per file (largest first), the dropped files
+// and the total to stderr
+func reportTokens(tree map[string]Entry, dropped []string, result []byte) error {
+	t, err := currentTokenizer()
+	if err != nil {
+		return err
+	}
+
+	paths := sortedPaths(tree)
+	tokens := map[string]int{}
+	for _, p := range paths {
+		tokens[p] = entryTokens(t, p, tree[p])
+	}
+	sort.SliceStable(paths, func(i, j int) bool {
+		return tokens[paths[i]] > tokens[paths[j]]
+	})
+
+	for _, p := range paths {
+		fmt.Fprintf(os.Stderr, "%8d  %s\n", tokens[p], p)
+	}
+	for _, p := range dropped {
+		fmt.Fprintf(os.Stderr, "%8s  %s (dropped)\n", "-", p)
+	}
+	fmt.Fprintf(os.Stderr, "%8d  total (%s)\n", outputTokens(t, tree, result), TokenizerName)
+	return nil
+}
@@ -0,0 +1,45 @@
+package filetree
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Archives are budgeted by the files in them, not by their binary bytes
+func TestTokenBudgetArchives(t *testing.T) {
+	defer keep(&MaxTokens)()
+	defer keep(&BudgetPolicy)()
+	defer keep(&TokenizerName)()
+	defer keep(&OutputFormat)()
+	BudgetPolicy, TokenizerName = BudgetPolicyDropLargest, "approx"
+	tok, err := currentTokenizer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree := map[string]Entry{}
+	for i := range 7 {
+		tree[fmt.Sprintf("f%d.txt", i)] = Entry{Perm: "0644", Content: strings.Repeat("word ", 10+i)}
+	}
+	perFile := entryTokens(tok, "f6.txt", tree["f6.txt"])
+
+	for _, format := range []string{FormatTar, FormatTarGz, FormatZip} {
+		OutputFormat = format
+		render := func(tree map[string]Entry) ([]byte, error) { return encodeTree(tree, format) }
+
+		MaxTokens = 10
+		if _, kept, dropped, err := applyTokenBudget(map[string]Entry{}, render); err != nil || len(kept) != 0 || len(dropped) != 0 {
+			t.Errorf("%s: an empty tree doesn't fit into 10 tokens: %v", format, err)
+		}
+
+		MaxTokens = treeTokens(tok, tree) - perFile
+		_, kept, dropped, err := applyTokenBudget(tree, render)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if len(dropped) != 1 || dropped[0] != "f6.txt" || len(kept) != 6 {
+			t.Errorf("%s: dropped %v to fit %d tokens, want [f6.txt]", format, dropped, MaxTokens)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package filetree
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/mrvnmyr/oat/common"
+)
+
+const (
+	DiffModeSummary = "summary"
+	DiffModeUnified = "unified"
+	DiffModeDelta   = "delta"
+)
+
+// DiffMode is what diff prints: a summary, a unified diff or a delta tree for
+// expand
+var DiffMode string = DiffModeSummary
+
+// ErrTreesDiffer is returned by diff if the trees aren't the same
+var ErrTreesDiffer = errors.New("the trees differ")
+
+// loadTree reads the snapshot at path or, for a directory, flattens it in
+// memory with the same rules as DirTreeToYAML. A .flattenignore or
+// .flattenallow directly in the directory is used too, but only for that side.
+func loadTree(path string) (map[string]Entry, error) {
+	info, err := os.Stat(path)
+	if err != nil || !info.IsDir() {
+		data, err := common.ReadFileOrStdin(path)
+		if err != nil {
+			return nil, err
+		}
+		tree, err := decodeTree(data, InputFormat)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", path, err)
+		}
+		for p, entry := range tree {
+			if entry.Delete {
+				delete(tree, p) // not part of a snapshot
+			}
+		}
+		return tree, nil
+	}
+
+	defer keep(&IgnoredGlobs)()
+	defer keep(&AllowedGlobs)()
+	seeksDotFiles := hasDotFlattenFile(path)
+	if seeksDotFiles {
+		if _, err := findRootAndPopulateFromDotFlattenFile(path); err != nil {
+			return nil, err
+		}
+	}
+	files, err := collectDirFiles(path, []string{}, seeksDotFiles)
+	if err != nil {
+		return nil, err
+	}
+	tree := map[string]Entry{}
+	err = readFiles(sortFiles(files), func(p string, entry Entry) error {
+		tree[p] = entry
+		return nil
+	})
+	return tree, err
+}
+
+// entryHash returns the hash of the content of entry, for truncated entries
+// that's the recorded one. It's "" if it isn't known.
+func entryHash(entry Entry) string {
+	switch {
+	case entry.isSymlink():
+		return contentHash(entry.Target)
+	case entry.Truncated:
+		return entry.Hash
+	}
+	content, err := entry.decodedContent()
+	if err != nil {
+		return ""
+	}
+	return contentHash(content)
+}
+
+// entryPerm returns the perm expand would give entry
+func entryPerm(entry Entry) os.FileMode {
+	if entry.isSymlink() {
+		return os.ModeSymlink
+	}
+	if perm, err := parsePerm(entry.Perm); err == nil && entry.Perm != "" {
+		return perm.Perm()
+	}
+	return 0o644
+}
+
+// entryText returns what diffs show for entry: the decoded content or the
+// target of a symlink
+func entryText(entry Entry) string {
+	if entry.isSymlink() {
+		return entry.Target
+	}
+	content, err := entry.decodedContent()
+	if err != nil {
+		return entry.Content
+	}
+	return content
+}
+
+// sameContent compares the content of two entries, truncated ones by their
+// hash. Entries whose content can't be compared are different.
+func sameContent(a, b Entry) bool {
+	if a.isSymlink() != b.isSymlink() {
+		return false
+	}
+	if !a.Truncated && !b.Truncated {
+		return entryText(a) == entryText(b)
+	}
+	ha, hb := entryHash(a), entryHash(b)
+	return ha != "" && ha == hb
+}
+
+// diffTrees lists the changes from a to b as expand would make them. Files
+// that were removed and added with the same content are renames.
+func diffTrees(a, b map[string]Entry) []fileChange {
+	var changes []fileChange
+	added := map[string]int{} // hash of the content -> index in changes
+	for _, p := range sortedPaths(b) {
+		eb := b[p]
+		ea, ok := a[p]
+		c := fileChange{Path: p, Entry: eb, Perm: entryPerm(eb)}
+		c.Entry.Content = entryText(eb)
+		switch {
+		case !ok:
+			c.Kind = changeAdd
+			if hash := entryHash(eb); hash != "" && c.Entry.Content != "" {
+				added[hash] = len(changes)
+			}
+		case !sameContent(ea, eb):
+			c.Kind = changeModify
+		case entryPerm(ea) != c.Perm:
+			c.Kind = changePerm
+		default:
+			continue
+		}
+		if ok {
+			c.OldContent, c.OldPerm = entryText(ea), entryPerm(ea)
+		}
+		changes = append(changes, c)
+	}
+
+	for _, p := range sortedPaths(a) {
+		ea := a[p]
+		if _, ok := b[p]; ok {
+			continue
+		}
+		if i, ok := added[entryHash(ea)]; ok && changes[i].Kind == changeAdd && changes[i].Entry.isSymlink() == ea.isSymlink() {
+			changes[i].Kind = changeRename
+			changes[i].From = p
+			changes[i].OldContent, changes[i].OldPerm = entryText(ea), entryPerm(ea)
+			continue
+		}
+		changes = append(changes, fileChange{
+			Path:       p,
+			Kind:       changeDelete,
+			Entry:      Entry{Delete: true},
+			OldContent: entryText(ea),
+			OldPerm:    entryPerm(ea),
+		})
+	}
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes
+}
+
+// deltaTree turns changes into a tree that expand applies to a, the hashes
+// are the ones of a so expand refuses to overwrite files that changed since
+func deltaTree(a, b map[string]Entry, changes []fileChange) map[string]Entry {
+	delta := map[string]Entry{}
+	for _, c := range changes {
+		switch c.Kind {
+		case changeDelete:
+			delta[c.Path] = Entry{Delete: true, Hash: entryHash(a[c.Path])}
+		case changeRename:
+			entry := Entry{RenamedFrom: c.From, Hash: entryHash(a[c.From])}
+			if c.Perm != c.OldPerm && !c.Entry.isSymlink() {
+				entry.Perm = b[c.Path].Perm
+			}
+			delta[c.Path] = entry
+		default:
+			entry := b[c.Path]
+			entry.Hash, entry.Size, entry.MTime = "", 0, ""
+			if c.Kind != changeAdd {
+				entry.Hash = entryHash(a[c.Path])
+			}
+			delta[c.Path] = entry
+		}
+	}
+	return delta
+}
+
+// summaryLine describes a change in one line
+func summaryLine(c fileChange) string {
+	perms := ""
+	if c.Kind != changeAdd && c.Kind != changeDelete && c.OldPerm != c.Perm {
+		perms = fmt.Sprintf(" (%04o -> %04o)", c.OldPerm.Perm(), c.Perm.Perm())
+	}
+	switch c.Kind {
+	case changeAdd:
+		return "added    " + c.Path
+	case changeDelete:
+		return "removed  " + c.Path
+	case changeRename:
+		return fmt.Sprintf("renamed  %s -> %s%s", c.From, c.Path, perms)
+	case changePerm:
+		return "perm     " + c.Path + perms
+	}
+	return "modified " + c.Path + perms
+}
+
+// DiffTrees compares the snapshots or directories at aPath and bPath and
+// prints the changes from a to b as DiffMode. It returns ErrTreesDiffer if
+// there are any.
+func DiffTrees(aPath, bPath string) error {
+	a, err := loadTree(aPath)
+	if err != nil {
+		return err
+	}
+	b, err := loadTree(bPath)
+	if err != nil {
+		return err
+	}
+	changes := diffTrees(a, b)
+
+	switch DiffMode {
+	case DiffModeSummary:
+		counts := map[string]int{}
+		for _, c := range changes {
+			fmt.Println(summaryLine(c))
+			counts[c.Kind]++
+		}
+		if len(changes) > 0 {
+			var parts []string
+			for _, kind := range []struct{ kind, label string }{
+				{changeAdd, "added"},
+				{changeDelete, "removed"},
+				{changeModify, "modified"},
+				{changePerm, "perm changed"},
+				{changeRename, "renamed"},
+			} {
+				if n := counts[kind.kind]; n > 0 {
+					parts = append(parts, fmt.Sprintf("%d %s", n, kind.label))
+				}
+			}
+			fmt.Fprintf(os.Stderr, "%s\n", strings.Join(parts, ", "))
+		}
+	case DiffModeUnified:
+		color := useColor()
+		for _, c := range changes {
+			fmt.Print(c.diff(color))
+		}
+	case DiffModeDelta:
+		data, err := encodeTree(deltaTree(a, b, changes), OutputFormat)
+		if err != nil {
+			return err
+		}
+		if err := common.WriteFileOrStd("+", data, 0644); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown diff mode: %s", DiffMode)
+	}
+
+	if len(changes) > 0 {
+		return ErrTreesDiffer
+	}
+	return nil
+}
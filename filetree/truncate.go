@@ -0,0 +1,170 @@
+package filetree
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/mrvnmyr/oat/common"
+)
+
+const (
+	SizePolicySkip           = "skip"
+	SizePolicyTruncateHead   = "truncate-head"
+	SizePolicyTruncateMiddle = "truncate-middle"
+	SizePolicyError          = "error"
+)
+
+var (
+	// MaxFileSize is the size in bytes above which FileSizePolicy applies, 0
+	// means unlimited
+	MaxFileSize int64 = 0
+
+	// FileSizePolicy decides what happens to files larger than MaxFileSize
+	FileSizePolicy string = SizePolicySkip
+)
+
+// reTruncated matches the line truncatedEntry puts in place of the left out
+// bytes
+var reTruncated = regexp.MustCompile(`(?m)^\.\.\. \[\d+ bytes truncated\] \.\.\.$`)
+
+// keepsTruncation returns true if content has a truncation line that isn't in
+// old, i.e. it's a truncated file whose reply dropped "truncated: true"
+func keepsTruncation(content string, old string) bool {
+	for _, line := range reTruncated.FindAllString(content, -1) {
+		if !strings.Contains(old, line) {
+			return true
+		}
+	}
+	return false
+}
+
+// sizeLimit applies MaxFileSize to the file relPath of size bytes, skip is true
+// if it's left out and truncate if only a part of it is kept. Binary files are
+// never truncated.
+func sizeLimit(relPath string, size int64, binary bool) (skip bool, truncate bool, err error) {
+	if MaxFileSize <= 0 || size <= MaxFileSize {
+		return false, false, nil
+	}
+	switch FileSizePolicy {
+	case SizePolicySkip:
+	case SizePolicyTruncateHead, SizePolicyTruncateMiddle:
+		if !binary {
+			return false, true, nil
+		}
+	case SizePolicyError:
+		return false, false, fmt.Errorf("%s has %d bytes which exceeds --max-file-size %d", relPath, size, MaxFileSize)
+	default:
+		return false, false, fmt.Errorf("unknown file size policy: %s", FileSizePolicy)
+	}
+	common.Debugf("Skipping %s, it has %d bytes\n", relPath, size)
+	return true, false, nil
+}
+
+// truncatedLengths returns how many bytes of the head and the tail of a file
+// are kept
+func truncatedLengths() (int64, int64) {
+	if FileSizePolicy == SizePolicyTruncateMiddle {
+		return MaxFileSize - MaxFileSize/2, MaxFileSize / 2
+	}
+	return MaxFileSize, 0
+}
+
+// readTruncated reads only the head and tail of the file at pathStr, the hash
+// is the one of the whole file
+func readTruncated(pathStr string, info os.FileInfo) (Entry, error) {
+	f, err := os.Open(pathStr)
+	if err != nil {
+		return Entry{}, err
+	}
+	defer f.Close()
+
+	size := info.Size()
+	headLen, tailLen := truncatedLengths()
+	head := make([]byte, headLen)
+	if _, err := f.ReadAt(head, 0); err != nil && err != io.EOF {
+		return Entry{}, err
+	}
+	tail := make([]byte, tailLen)
+	if _, err := f.ReadAt(tail, size-tailLen); err != nil && err != io.EOF {
+		return Entry{}, err
+	}
+
+	hash := ""
+	if !NoHash {
+		h := xxhash.New()
+		if _, err := io.Copy(h, io.NewSectionReader(f, 0, size)); err != nil {
+			return Entry{}, err
+		}
+		hash = fmt.Sprintf("%016x", h.Sum64())
+	}
+	return truncatedEntry(fmt.Sprintf("%04o", info.Mode().Perm()), head, tail, size, hash), nil
+}
+
+// truncateContent is readTruncated for content that is already in memory
+func truncateContent(perm string, b []byte) Entry {
+	headLen, tailLen := truncatedLengths()
+	hash := ""
+	if !NoHash {
+		hash = contentHash(string(b))
+	}
+	return truncatedEntry(perm, b[:headLen], b[int64(len(b))-tailLen:], int64(len(b)), hash)
+}
+
+// truncatedEntry joins head and tail with a line that says how much was left
+// out, both are cut at line boundaries if possible
+func truncatedEntry(perm string, head []byte, tail []byte, size int64, hash string) Entry {
+	head = cutHead(head)
+	tail = cutTail(tail)
+	omitted := size - int64(len(head)) - int64(len(tail))
+
+	content := string(head)
+	if content != "" && content[len(content)-1] != '\n' {
+		content += "\n"
+	}
+	content += fmt.Sprintf("... [%d bytes truncated] ...\n", omitted)
+	content += string(tail)
+	return Entry{
+		Perm:      perm,
+		Hash:      hash,
+		Size:      size,
+		Content:   content,
+		Truncated: true,
+	}
+}
+
+// cutHead drops the partial last line of head, or a partial UTF-8 character if
+// there's only one line
+func cutHead(head []byte) []byte {
+	for i := len(head) - 1; i >= 0; i-- {
+		if head[i] == '\n' {
+			return head[:i+1]
+		}
+	}
+	i := len(head) - 1
+	for i > 0 && !utf8.RuneStart(head[i]) {
+		i--
+	}
+	if i >= 0 && !utf8.FullRune(head[i:]) {
+		head = head[:i]
+	}
+	return head
+}
+
+// cutTail drops the partial first line of tail, or a partial UTF-8 character
+// if there's only one line
+func cutTail(tail []byte) []byte {
+	for i, b := range tail {
+		if b == '\n' {
+			return tail[i+1:]
+		}
+	}
+	for len(tail) > 0 && !utf8.RuneStart(tail[0]) {
+		tail = tail[1:]
+	}
+	return tail
+}
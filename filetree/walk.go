@@ -0,0 +1,99 @@
+package filetree
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/mrvnmyr/oat/common"
+)
+
+// FollowSymlinks makes flatten inline the files symlinks point to instead of
+// recording the links
+var FollowSymlinks bool = false
+
+// onWalkDir is called for every directory the walk descends into, watch sets
+// it
+var onWalkDir func(dir string)
+
+// walkTree works like filepath.Walk, but with FollowSymlinks symlinks are
+// followed. The info of a followed symlink is the one of its target. A
+// symlink pointing to one of its parent directories (a cycle) or to nothing is
+// reported as a symlink.
+func walkTree(root string, fn filepath.WalkFunc) error {
+	info, err := os.Lstat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = walkPath(root, info, nil, fn)
+	}
+	if errors.Is(err, filepath.SkipDir) || errors.Is(err, filepath.SkipAll) {
+		return nil
+	}
+	return err
+}
+
+// walkPath walks p, parents are the real paths of the directories above it
+func walkPath(p string, info os.FileInfo, parents []string, fn filepath.WalkFunc) error {
+	if FollowSymlinks && info.Mode()&os.ModeSymlink != 0 {
+		info = followSymlink(p, info, parents)
+	}
+
+	err := fn(p, info, nil)
+	if err != nil || !info.IsDir() {
+		if errors.Is(err, filepath.SkipDir) && info.IsDir() {
+			return nil
+		}
+		return err
+	}
+
+	if onWalkDir != nil {
+		onWalkDir(p)
+	}
+
+	if FollowSymlinks {
+		real, err := filepath.EvalSymlinks(p)
+		if err != nil {
+			return fn(p, info, err)
+		}
+		parents = append(parents[:len(parents):len(parents)], real)
+	}
+
+	entries, err := os.ReadDir(p)
+	if err != nil {
+		return fn(p, info, err)
+	}
+	for _, e := range entries {
+		child := filepath.Join(p, e.Name())
+		childInfo, err := e.Info()
+		if err != nil {
+			if err := fn(child, nil, err); err != nil && !errors.Is(err, filepath.SkipDir) {
+				return err
+			}
+			continue
+		}
+		if err := walkPath(child, childInfo, parents, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// followSymlink returns the info of the symlink's target, or info itself if
+// the target is missing or following it would loop
+func followSymlink(p string, info os.FileInfo, parents []string) os.FileInfo {
+	target, err := os.Stat(p)
+	if err != nil {
+		common.Debugf("Not following %s: %s\n", p, err)
+		return info
+	}
+	if target.IsDir() {
+		real, err := filepath.EvalSymlinks(p)
+		if err != nil || slices.Contains(parents, real) {
+			common.Debugf("Not following %s, it would loop\n", p)
+			return info
+		}
+	}
+	return target
+}
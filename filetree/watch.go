@@ -0,0 +1,271 @@
+package filetree
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+var (
+	// Watch keeps flattening whenever the selected files change
+	Watch bool = false
+
+	// WatchPoll polls even where the OS can notify about changes
+	WatchPoll bool = false
+
+	// WatchInterval is how often the files are polled
+	WatchInterval time.Duration = time.Second
+
+	// WatchDebounce is how long it has to be quiet before flattening again
+	WatchDebounce time.Duration = 200 * time.Millisecond
+)
+
+// changeWatcher tells watch when files may have changed
+type changeWatcher interface {
+	// Changes receives a value when something may have changed
+	Changes() <-chan struct{}
+
+	// Watch is called after every flatten with the directories to watch
+	Watch(dirs []string) error
+}
+
+// pollWatcher doesn't know anything, it just asks to check every interval
+type pollWatcher struct {
+	changes chan struct{}
+}
+
+func newPollWatcher() *pollWatcher {
+	w := &pollWatcher{changes: make(chan struct{}, 1)}
+	go func() {
+		for range time.Tick(WatchInterval) {
+			select {
+			case w.changes <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return w
+}
+
+func (w *pollWatcher) Changes() <-chan struct{} {
+	return w.changes
+}
+
+func (w *pollWatcher) Watch(dirs []string) error {
+	return nil
+}
+
+// cachedEntry is the result of readEntry for a file as it was when it was
+// read
+type cachedEntry struct {
+	Size  int64
+	MTime time.Time
+	Mode  os.FileMode
+	Entry Entry
+	OK    bool
+}
+
+var (
+	// entryCache is only used with --watch, it's keyed by the path on disk
+	entryCache     map[string]cachedEntry
+	entryCacheUsed map[string]cachedEntry
+	entryCacheLock sync.Mutex
+	entriesRead    atomic.Int64
+)
+
+// readEntryCached is readEntry, with --watch files that didn't change since
+// the last flatten aren't read again
+func readEntryCached(f flattenFile) (Entry, bool, error) {
+	if entryCache == nil {
+		return readEntry(f.Full, f.Path, f.Info)
+	}
+	entryCacheLock.Lock()
+	c, ok := entryCache[f.Full]
+	entryCacheLock.Unlock()
+	if !ok || c.Size != f.Info.Size() || !c.MTime.Equal(f.Info.ModTime()) || c.Mode != f.Info.Mode() {
+		entry, ok, err := readEntry(f.Full, f.Path, f.Info)
+		if err != nil {
+			return entry, ok, err
+		}
+		entriesRead.Add(1)
+		c = cachedEntry{Size: f.Info.Size(), MTime: f.Info.ModTime(), Mode: f.Info.Mode(), Entry: entry, OK: ok}
+	}
+	entryCacheLock.Lock()
+	entryCacheUsed[f.Full] = c
+	entryCacheLock.Unlock()
+	return c.Entry, c.OK, nil
+}
+
+// fingerprint hashes what is known about files without reading them
+func fingerprint(files []flattenFile) uint64 {
+	h := xxhash.New()
+	for _, f := range files {
+		fmt.Fprintf(h, "%s\x00%s\x00%d\x00%d\x00%d\n", f.Path, f.Full, f.Info.Size(), f.Info.ModTime().UnixNano(), f.Info.Mode())
+	}
+	return h.Sum64()
+}
+
+// watchDirs returns the walked directories, roots and the directories
+// between them and files
+func watchDirs(walked []string, roots []string, files []flattenFile) []string {
+	seen := map[string]bool{}
+	var dirs []string
+	add := func(dir string) bool {
+		if seen[dir] {
+			return false
+		}
+		seen[dir] = true
+		dirs = append(dirs, dir)
+		return true
+	}
+
+	for _, dir := range walked {
+		if dir, err := filepath.Abs(dir); err == nil {
+			add(dir)
+		}
+	}
+	isRoot := map[string]bool{}
+	for _, root := range roots {
+		root, err := filepath.Abs(root)
+		if err != nil {
+			continue
+		}
+		if info, err := os.Stat(root); err == nil && !info.IsDir() {
+			root = filepath.Dir(root)
+		}
+		isRoot[root] = true
+		add(root)
+	}
+	for _, f := range files {
+		dir, err := filepath.Abs(filepath.Dir(f.Full))
+		if err != nil {
+			continue
+		}
+		for !isRoot[dir] && add(dir) {
+			parent := filepath.Dir(dir)
+			if parent == dir {
+				break
+			}
+			dir = parent
+		}
+	}
+	return dirs
+}
+
+// WatchFlatten flattens like DirTreeToYAML (without args) or
+// FlattenArgsToYAML to outPath, and again whenever the selected files change.
+// Only the files that changed are read again. It runs until it's killed.
+func WatchFlatten(args []string, outPath string, noIgnores bool) error {
+	if outPath == "+" || outPath == "-" {
+		return errors.New("--watch needs an --output file")
+	}
+	absOut, err := filepath.Abs(outPath)
+	if err != nil {
+		return err
+	}
+	outDir, outBase := filepath.Split(absOut)
+	tmpPrefix := "." + outBase + ".tmp"
+
+	// never flatten the output (or its temporary file) into itself
+	isOutput := func(f flattenFile) bool {
+		abs, err := filepath.Abs(f.Full)
+		if err != nil {
+			return false
+		}
+		dir, base := filepath.Split(abs)
+		return dir == outDir && (base == outBase || strings.HasPrefix(base, tmpPrefix))
+	}
+
+	var walked []string
+	onWalkDir = func(dir string) { walked = append(walked, dir) }
+	defer func() { onWalkDir = nil }()
+
+	collect := func() ([]flattenFile, []string, string, error) {
+		walked = walked[:0]
+		files, templateDir, err := collectFiles(args, noIgnores)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		roots := args
+		if len(args) == 0 {
+			roots = []string{templateDir}
+		}
+		kept := files[:0]
+		for _, f := range files {
+			if !isOutput(f) {
+				kept = append(kept, f)
+			}
+		}
+		return sortFiles(kept), roots, templateDir, nil
+	}
+
+	watcher, err := newChangeWatcher()
+	if err != nil {
+		return err
+	}
+
+	entryCache = map[string]cachedEntry{}
+	var last uint64
+	flatten := func(first bool) error {
+		files, roots, templateDir, err := collect()
+		if err != nil {
+			return err
+		}
+		if err := watcher.Watch(watchDirs(walked, roots, files)); err != nil {
+			return err
+		}
+		fp := fingerprint(files)
+		if !first && fp == last {
+			return nil // nothing that flatten looks at changed
+		}
+
+		// write to a temporary file first, so readers never see half of it
+		tmp, err := os.CreateTemp(outDir, tmpPrefix+"*")
+		if err != nil {
+			return err
+		}
+		tmp.Close()
+		defer os.Remove(tmp.Name())
+		if err := os.Chmod(tmp.Name(), 0644); err != nil {
+			return err
+		}
+
+		entryCacheUsed = map[string]cachedEntry{}
+		entriesRead.Store(0)
+		if err := writeFiles(files, tmp.Name(), templateDir); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp.Name(), absOut); err != nil {
+			return err
+		}
+		entryCache = entryCacheUsed
+		last = fp
+		fmt.Fprintf(os.Stderr, "%s flattened %d files to %s, read %d\n",
+			time.Now().Format("15:04:05"), len(files), outPath, entriesRead.Load())
+		return nil
+	}
+
+	if err := flatten(true); err != nil {
+		return err
+	}
+	var quiet <-chan time.Time
+	for {
+		select {
+		case <-watcher.Changes():
+			quiet = time.After(WatchDebounce)
+		case <-quiet:
+			quiet = nil
+			if err := flatten(false); err != nil {
+				// a file may have vanished in between, try again on the next change
+				fmt.Fprintf(os.Stderr, "flatten failed: %v\n", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,108 @@
+//go:build linux
+
+package filetree
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+)
+
+const inotifyMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MODIFY | syscall.IN_ATTRIB |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF | syscall.IN_ONLYDIR
+
+// inotifyWatcher watches directories with inotify, files changing in them
+// are reported on the directory
+type inotifyWatcher struct {
+	fd      int
+	changes chan struct{}
+
+	lock sync.Mutex
+	dirs map[string]int // directory -> watch descriptor
+	wds  map[int]string
+}
+
+// newChangeWatcher uses inotify, or polls if that isn't available
+func newChangeWatcher() (changeWatcher, error) {
+	if WatchPoll {
+		return newPollWatcher(), nil
+	}
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "inotify isn't available (%v), polling every %s\n", err, WatchInterval)
+		return newPollWatcher(), nil
+	}
+	w := &inotifyWatcher{
+		fd:      fd,
+		changes: make(chan struct{}, 1),
+		dirs:    map[string]int{},
+		wds:     map[int]string{},
+	}
+	go w.read()
+	return w, nil
+}
+
+func (w *inotifyWatcher) Changes() <-chan struct{} {
+	return w.changes
+}
+
+// Watch adds the dirs that aren't watched yet, the ones that aren't needed
+// anymore stay watched (a change there just flattens to the same fingerprint)
+func (w *inotifyWatcher) Watch(dirs []string) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for _, dir := range dirs {
+		if _, ok := w.dirs[dir]; ok {
+			continue
+		}
+		wd, err := syscall.InotifyAddWatch(w.fd, dir, inotifyMask)
+		if errors.Is(err, syscall.ENOSPC) {
+			return fmt.Errorf("watching %s: %w (raise fs.inotify.max_user_watches or use --watch-poll)", dir, err)
+		}
+		if errors.Is(err, syscall.ENOENT) || errors.Is(err, syscall.ENOTDIR) {
+			continue // gone since it was collected, its parent notices
+		}
+		if err != nil {
+			return fmt.Errorf("watching %s: %w", dir, err)
+		}
+		w.dirs[dir] = wd
+		w.wds[wd] = dir
+	}
+	return nil
+}
+
+// read signals a change for every batch of events
+func (w *inotifyWatcher) read() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := syscall.Read(w.fd, buf)
+		if errors.Is(err, syscall.EINTR) {
+			continue
+		}
+		if err != nil || n <= 0 {
+			fmt.Fprintf(os.Stderr, "reading inotify events: %v\n", err)
+			return
+		}
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			wd := int(int32(binary.NativeEndian.Uint32(buf[off:])))
+			mask := binary.NativeEndian.Uint32(buf[off+4:])
+			nameLen := int(binary.NativeEndian.Uint32(buf[off+12:]))
+			if mask&syscall.IN_IGNORED != 0 {
+				// the directory is gone, forget it so it's added again if it
+				// comes back
+				w.lock.Lock()
+				delete(w.dirs, w.wds[wd])
+				delete(w.wds, wd)
+				w.lock.Unlock()
+			}
+			off += syscall.SizeofInotifyEvent + nameLen
+		}
+		select {
+		case w.changes <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package filetree
+
+// newChangeWatcher polls, there is no notification support on this OS
+func newChangeWatcher() (changeWatcher, error) {
+	return newPollWatcher(), nil
+}